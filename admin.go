@@ -203,12 +203,20 @@ func (adm Admin) SetConfig(cluster string, scope HelixConfigScope, properties ma
 	return nil
 }
 
-// GetConfig obtains the configuration value of a property, defined by a config scope
+// GetConfig obtains the configuration value of a property, defined by a config scope. It
+// returns nil if the configuration cannot be read; use ReadConfig to get the error.
 func (adm Admin) GetConfig(cluster string, scope HelixConfigScope, keys []string) map[string]interface{} {
+	result, _ := adm.ReadConfig(cluster, scope, keys)
+	return result
+}
+
+// ReadConfig obtains the configuration value of a property, defined by a config scope, or
+// the error that kept it from reading the configuration.
+func (adm Admin) ReadConfig(cluster string, scope HelixConfigScope, keys []string) (map[string]interface{}, error) {
 	conn := newConnection(adm.zkSvr)
 	err := conn.Connect()
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	defer conn.Disconnect()
 
@@ -218,7 +226,11 @@ func (adm Admin) GetConfig(cluster string, scope HelixConfigScope, keys []string
 	case ConfigScopeCluster:
 		kb := keyBuilder{clusterID: cluster}
 		for _, k := range keys {
-			result[k] = conn.GetSimpleFieldValueByKey(kb.clusterConfig(), k)
+			v, err := conn.GetSimpleFieldValueByKey(kb.clusterConfig(), k)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = v
 		}
 	case ConfigScopeConstraint:
 	case ConfigScopeParticipant:
@@ -226,7 +238,7 @@ func (adm Admin) GetConfig(cluster string, scope HelixConfigScope, keys []string
 	case ConfigScopeResource:
 	}
 
-	return result
+	return result, nil
 }
 
 func (adm Admin) AddInstance(cluster string, config InstanceConfig) error {
@@ -386,6 +398,94 @@ func (adm Admin) DropResource(cluster string, resource string) error {
 	return nil
 }
 
+// AddStateModelDef adds the state model definition to the cluster, under
+// /{cluster}/STATEMODELDEFS/{name}
+func (adm Admin) AddStateModelDef(cluster string, def *StateModelDefinition) error {
+	if err := def.Validate(); err != nil {
+		return err
+	}
+
+	conn := newConnection(adm.zkSvr)
+	err := conn.Connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	if ok, err := conn.IsClusterSetup(cluster); !ok || err != nil {
+		return ErrClusterNotSetup
+	}
+
+	kb := keyBuilder{clusterID: cluster}
+	if exists, err := conn.Exists(kb.stateModel(def.Name)); exists || err != nil {
+		return ErrStateModelDefExists
+	}
+
+	return conn.CreateRecordWithPath(kb.stateModel(def.Name), def.Record())
+}
+
+// DropStateModelDef removes the state model definition from the cluster. A state model
+// still used by resources cannot be dropped.
+func (adm Admin) DropStateModelDef(cluster string, name string) error {
+	conn := newConnection(adm.zkSvr)
+	err := conn.Connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	if ok, err := conn.IsClusterSetup(cluster); !ok || err != nil {
+		return ErrClusterNotSetup
+	}
+
+	kb := keyBuilder{clusterID: cluster}
+	if exists, err := conn.Exists(kb.stateModel(name)); !exists || err != nil {
+		return ErrStateModelDefNotExist
+	}
+
+	resources, err := conn.Children(kb.idealStates())
+	if err != nil {
+		return err
+	}
+	for _, resource := range resources {
+		is, err := conn.GetRecordFromPath(kb.idealStateForResource(resource))
+		if err != nil {
+			continue
+		}
+		if is.GetStringField("STATE_MODEL_DEF_REF", "") == name {
+			return ErrStateModelDefInUse
+		}
+	}
+
+	return conn.DeleteTree(kb.stateModel(name))
+}
+
+// GetStateModelDef retrieves the state model definition of the cluster
+func (adm Admin) GetStateModelDef(cluster string, name string) (*StateModelDefinition, error) {
+	conn := newConnection(adm.zkSvr)
+	err := conn.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Disconnect()
+
+	if ok, err := conn.IsClusterSetup(cluster); !ok || err != nil {
+		return nil, ErrClusterNotSetup
+	}
+
+	kb := keyBuilder{clusterID: cluster}
+	if exists, err := conn.Exists(kb.stateModel(name)); !exists || err != nil {
+		return nil, ErrStateModelDefNotExist
+	}
+
+	record, err := conn.GetRecordFromPath(kb.stateModel(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStateModelDefinitionFromRecord(record)
+}
+
 // EnableResource enables the specified resource in the cluster
 func (adm Admin) EnableResource(cluster string, resource string) error {
 	conn := newConnection(adm.zkSvr)
@@ -543,15 +643,300 @@ func (adm Admin) GetInstances(cluster string) ([]string, error) {
 	return conn.Children(kb.instances())
 }
 
-// Rebalance not implemented yet TODO
-func (adm Admin) Rebalance(cluster string, resource string, replica int) {
+// GetHealthReports returns the health reports published by the instance, one record per
+// report name, with the values of the report in the simpleFields.
+func (adm Admin) GetHealthReports(cluster string, instance string) ([]*Record, error) {
+	conn := newConnection(adm.zkSvr)
+	err := conn.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Disconnect()
+
+	// make sure the cluster is already setup
+	if ok, err := conn.IsClusterSetup(cluster); !ok || err != nil {
+		return nil, ErrClusterNotSetup
+	}
+
+	kb := keyBuilder{clusterID: cluster}
+	if exists, err := conn.Exists(kb.participantConfig(instance)); !exists || err != nil {
+		if !exists {
+			return nil, ErrNodeNotExist
+		}
+		return nil, err
+	}
+
+	result := []*Record{}
+	if exists, _ := conn.Exists(kb.healthReport(instance)); !exists {
+		return result, nil
+	}
+
+	reports, err := conn.Children(kb.healthReport(instance))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range reports {
+		record, err := conn.GetRecordFromPath(kb.healthReportForName(instance, name))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, record)
+	}
+
+	return result, nil
+}
+
+// SetPreferenceList sets the preference list of a partition of a SEMI_AUTO resource. The
+// first live instance of the list gets the top state of the state model, like MASTER, and
+// the next ones get the secondary state, like SLAVE, up to the number of replicas.
+func (adm Admin) SetPreferenceList(cluster string, resource string, partition string, instances []string) error {
+	conn := newConnection(adm.zkSvr)
+	err := conn.Connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	// make sure the cluster is already setup
+	if ok, err := conn.IsClusterSetup(cluster); !ok || err != nil {
+		return ErrClusterNotSetup
+	}
+
+	kb := keyBuilder{clusterID: cluster}
+	isPath := kb.idealStateForResource(resource)
+	if exists, err := conn.Exists(isPath); !exists || err != nil {
+		if !exists {
+			return ErrResourceNotExists
+		}
+		return err
+	}
+
+	for _, instance := range instances {
+		if exists, err := conn.Exists(kb.participantConfig(instance)); !exists || err != nil {
+			if !exists {
+				return ErrNodeNotExist
+			}
+			return err
+		}
+	}
+
+	is, err := conn.GetRecordFromPath(isPath)
+	if err != nil {
+		return err
+	}
+
+	is.SetListField(partition, instances)
+	return conn.SetRecordForPath(isPath, is)
+}
+
+// SetPartitionAssignment sets the exact state of a partition of a CUSTOMIZED resource on
+// each instance, as instance -> state.
+func (adm Admin) SetPartitionAssignment(cluster string, resource string, partition string, instanceStates map[string]string) error {
+	conn := newConnection(adm.zkSvr)
+	err := conn.Connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	// make sure the cluster is already setup
+	if ok, err := conn.IsClusterSetup(cluster); !ok || err != nil {
+		return ErrClusterNotSetup
+	}
+
+	kb := keyBuilder{clusterID: cluster}
+	isPath := kb.idealStateForResource(resource)
+	if exists, err := conn.Exists(isPath); !exists || err != nil {
+		if !exists {
+			return ErrResourceNotExists
+		}
+		return err
+	}
+
+	for instance := range instanceStates {
+		if exists, err := conn.Exists(kb.participantConfig(instance)); !exists || err != nil {
+			if !exists {
+				return ErrNodeNotExist
+			}
+			return err
+		}
+	}
+
+	is, err := conn.GetRecordFromPath(isPath)
+	if err != nil {
+		return err
+	}
+
+	is.RemoveMapField(partition)
+	for instance, state := range instanceStates {
+		is.SetMapField(partition, instance, state)
+	}
+	return conn.SetRecordForPath(isPath, is)
+}
+
+// ResetPartition implements the helix-admin.sh --resetPartition. It brings the partitions of
+// the resource in the ERROR state on the live instance back to the initial state of the state
+// model, e.g. ERROR->OFFLINE, from where the controller takes over again.
+// ./helix-admin.sh --zkSvr localhost:2199 --resetPartition MYCLUSTER localhost_12913 myDB myDB_0
+func (adm Admin) ResetPartition(cluster string, instance string, resource string, partitions []string) error {
 	conn := newConnection(adm.zkSvr)
 	err := conn.Connect()
 	if err != nil {
-		fmt.Println("Failed to connect to zookeeper.")
-		return
+		return err
 	}
 	defer conn.Disconnect()
 
-	fmt.Println("Not implemented")
+	// make sure the cluster is already setup
+	if ok, err := conn.IsClusterSetup(cluster); !ok || err != nil {
+		return ErrClusterNotSetup
+	}
+
+	kb := keyBuilder{clusterID: cluster}
+	if exists, err := conn.Exists(kb.participantConfig(instance)); !exists || err != nil {
+		if !exists {
+			return ErrNodeNotExist
+		}
+		return err
+	}
+
+	if exists, err := conn.Exists(kb.liveInstance(instance)); !exists || err != nil {
+		if !exists {
+			return ErrInstanceNotAlive
+		}
+		return err
+	}
+	liveInstance, err := conn.GetRecordFromPath(kb.liveInstance(instance))
+	if err != nil {
+		return err
+	}
+	sessionID := liveInstance.GetStringField("SESSION_ID", "")
+
+	isPath := kb.idealStateForResource(resource)
+	if exists, err := conn.Exists(isPath); !exists || err != nil {
+		if !exists {
+			return ErrResourceNotExists
+		}
+		return err
+	}
+	is, err := conn.GetRecordFromPath(isPath)
+	if err != nil {
+		return err
+	}
+
+	stateModel := is.GetStringField("STATE_MODEL_DEF_REF", "")
+	if exists, err := conn.Exists(kb.stateModel(stateModel)); !exists || err != nil {
+		return ErrStateModelDefNotExist
+	}
+	smd, err := conn.GetRecordFromPath(kb.stateModel(stateModel))
+	if err != nil {
+		return err
+	}
+	def, err := NewStateModelDefinitionFromRecord(smd)
+	if err != nil {
+		return err
+	}
+
+	// every partition must be in ERROR before any of them is reset
+	csPath := kb.currentStateForResource(instance, sessionID, resource)
+	if exists, err := conn.Exists(csPath); !exists || err != nil {
+		if !exists {
+			return ErrPartitionNotInError
+		}
+		return err
+	}
+	cs, err := conn.GetRecordFromPath(csPath)
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		if cs.GetMapField(partition, "CURRENT_STATE") != "ERROR" {
+			return ErrPartitionNotInError
+		}
+	}
+
+	factoryName := is.GetStringField("STATE_MODEL_FACTORY_NAME", "DEFAULT")
+	for _, partition := range partitions {
+		t := stateTransition{instance: instance, fromState: "ERROR", toState: def.InitialState}
+		msg := newStateTransitionMessage("ADMIN", conn.GetSessionID(), liveInstance, resource, partition, def.Name, factoryName, t)
+		if err := conn.CreateRecordWithPath(kb.message(instance, msg.ID), msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rebalance implements the helix-admin.sh --rebalance. It sets the number of replicas
+// of the resource, and assigns the partitions and their states evenly to the enabled
+// instances of the cluster, into the preference lists of the ideal state listFields and
+// the states of the mapFields. Any previous assignment is replaced.
+// ./helix-admin.sh --zkSvr localhost:2199 --rebalance MYCLUSTER myDB 3
+func (adm Admin) Rebalance(cluster string, resource string, replica int) error {
+	if replica < 1 {
+		return ErrInvalidReplicas
+	}
+
+	conn := newConnection(adm.zkSvr)
+	err := conn.Connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	// make sure the cluster is already setup
+	if ok, err := conn.IsClusterSetup(cluster); !ok || err != nil {
+		return ErrClusterNotSetup
+	}
+
+	kb := keyBuilder{clusterID: cluster}
+	isPath := kb.idealStateForResource(resource)
+	if exists, err := conn.Exists(isPath); !exists || err != nil {
+		if !exists {
+			return ErrResourceNotExists
+		}
+		return err
+	}
+
+	is, err := conn.GetRecordFromPath(isPath)
+	if err != nil {
+		return err
+	}
+
+	stateModel := is.GetStringField("STATE_MODEL_DEF_REF", "")
+	if exists, err := conn.Exists(kb.stateModel(stateModel)); !exists || err != nil {
+		return ErrStateModelDefNotExist
+	}
+	smd, err := conn.GetRecordFromPath(kb.stateModel(stateModel))
+	if err != nil {
+		return err
+	}
+	def, err := NewStateModelDefinitionFromRecord(smd)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := conn.Children(kb.instances())
+	if err != nil {
+		return err
+	}
+
+	instances := []string{}
+	for _, node := range nodes {
+		config, err := conn.GetRecordFromPath(kb.participantConfig(node))
+		if err != nil {
+			return err
+		}
+		if config.GetBooleanField("HELIX_ENABLED", true) {
+			instances = append(instances, node)
+		}
+	}
+	if len(instances) < replica {
+		return ErrNotEnoughInstances
+	}
+
+	is.SetIntField("REPLICAS", replica)
+	computeIdealStateAssignment(is, def, instances)
+
+	return conn.SetRecordForPath(isPath, is)
 }
@@ -3,6 +3,7 @@ package gohelix
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -115,6 +116,11 @@ func TestSetConfig(t *testing.T) {
 	if prop["allowParticipantAutoJoin"] != "true" {
 		t.Error("allowParticipantAutoJoin config set/get failed")
 	}
+
+	// the config of a cluster that does not exist cannot be read
+	if _, err := a.ReadConfig(cluster+"_missing", "CLUSTER", []string{"allowParticipantAutoJoin"}); err != zk.ErrNoNode {
+		t.Errorf("expect zk.ErrNoNode, got %v", err)
+	}
 }
 
 func TestAddDropNode(t *testing.T) {
@@ -280,6 +286,153 @@ func TestEnableDisableResource(t *testing.T) {
 	}
 }
 
+func TestSetPreferenceList(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "AdminTest_TestSetPreferenceList_" + now.Format("20060102150405")
+	resource := "resource"
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+
+	a.AddNode(cluster, "localhost_12913")
+	a.AddNode(cluster, "localhost_12914")
+	instances := []string{"localhost_12914", "localhost_12913"}
+
+	// expect error if resource not exist
+	if err := a.SetPreferenceList(cluster, resource, "resource_0", instances); err != ErrResourceNotExists {
+		t.Error("expect ErrResourceNotExists")
+	}
+
+	if err := a.AddResource(cluster, resource, 4, "MasterSlave"); err != nil {
+		t.Error("fail addResource")
+	}
+
+	// expect error if an instance is not in the cluster
+	if err := a.SetPreferenceList(cluster, resource, "resource_0", []string{"localhost_1"}); err != ErrNodeNotExist {
+		t.Error("expect ErrNodeNotExist")
+	}
+
+	if err := a.SetPreferenceList(cluster, resource, "resource_0", instances); err != nil {
+		t.Error(err)
+	}
+
+	conn := newConnection(testZkSvr)
+	if err := conn.Connect(); err != nil {
+		t.Error("Failed to connect to test zookeeper")
+	}
+	defer conn.Disconnect()
+
+	kb := keyBuilder{cluster}
+	is, err := conn.GetRecordFromPath(kb.idealStateForResource(resource))
+	if err != nil {
+		t.Error(err)
+	}
+	if list := is.GetListField("resource_0"); len(list) != 2 || list[0] != "localhost_12914" {
+		t.Errorf("wrong preference list %v", list)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "AdminTest_TestRebalance_" + now.Format("20060102150405")
+	resource := "resource"
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+
+	a.AddNode(cluster, "localhost_12913")
+	a.AddNode(cluster, "localhost_12914")
+
+	// expect error if resource not exist
+	if err := a.Rebalance(cluster, resource, 2); err != ErrResourceNotExists {
+		t.Error("expect ErrResourceNotExists")
+	}
+
+	if err := a.AddResource(cluster, resource, 4, "MasterSlave"); err != nil {
+		t.Error("fail addResource")
+	}
+
+	// expect error if there are more replicas than instances
+	if err := a.Rebalance(cluster, resource, 3); err != ErrNotEnoughInstances {
+		t.Error("expect ErrNotEnoughInstances")
+	}
+
+	if err := a.Rebalance(cluster, resource, 2); err != nil {
+		t.Error(err)
+	}
+
+	conn := newConnection(testZkSvr)
+	if err := conn.Connect(); err != nil {
+		t.Error("Failed to connect to test zookeeper")
+	}
+	defer conn.Disconnect()
+
+	kb := keyBuilder{cluster}
+	is, err := conn.GetRecordFromPath(kb.idealStateForResource(resource))
+	if err != nil {
+		t.Error(err)
+	}
+	if is.GetIntField("REPLICAS", 0) != 2 || len(is.ListFields) != 4 || len(is.MapFields) != 4 {
+		t.Errorf("wrong ideal state %s", is)
+	}
+	if states := is.MapFields["resource_0"]; len(states) != 2 {
+		t.Errorf("wrong states of resource_0: %v", states)
+	}
+}
+
+func TestResetPartition(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "AdminTest_TestResetPartition_" + now.Format("20060102150405")
+	resource := "resource"
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+
+	partitions := []string{"resource_0"}
+
+	// expect error if the instance is not in the cluster
+	if err := a.ResetPartition(cluster, "localhost_12913", resource, partitions); err != ErrNodeNotExist {
+		t.Error("expect ErrNodeNotExist")
+	}
+
+	// expect error if the instance is not alive
+	a.AddNode(cluster, "localhost_12913")
+	if err := a.ResetPartition(cluster, "localhost_12913", resource, partitions); err != ErrInstanceNotAlive {
+		t.Error("expect ErrInstanceNotAlive")
+	}
+}
+
+func TestGetHealthReports(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "AdminTest_TestGetHealthReports_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+
+	// expect error if the instance is not in the cluster
+	if _, err := a.GetHealthReports(cluster, "localhost_12913"); err != ErrNodeNotExist {
+		t.Error("expect ErrNodeNotExist")
+	}
+
+	a.AddNode(cluster, "localhost_12913")
+	reports, err := a.GetHealthReports(cluster, "localhost_12913")
+	if err != nil || len(reports) != 0 {
+		t.Errorf("expect no health report, got %v %v", reports, err)
+	}
+}
+
 func connectLocalZk(t *testing.T) *zk.Conn {
 	zkServers := strings.Split(testZkSvr, ",")
 	conn, _, err := zk.Connect(zkServers, time.Second)
@@ -322,3 +475,57 @@ func verifyChildrenCount(t *testing.T, path string, count int32) {
 		t.Errorf("Node %s should have %d children, but only have %d children", path, count, stat.NumChildren)
 	}
 }
+
+func TestStateModelDef(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "AdminTest_TestStateModelDef_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+
+	def, err := NewStateModelDefinitionBuilder("Bootstrap").
+		AddState("ONLINE", "R").
+		AddState("BOOTSTRAP", "").
+		AddState("OFFLINE", "").
+		AddState("DROPPED", "").
+		InitialState("OFFLINE").
+		AddTransition("OFFLINE", "BOOTSTRAP").
+		AddTransition("BOOTSTRAP", "ONLINE").
+		AddTransition("ONLINE", "OFFLINE").
+		AddTransition("OFFLINE", "DROPPED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.AddStateModelDef(cluster, def); err != nil {
+		t.Error(err)
+	}
+	if err := a.AddStateModelDef(cluster, def); err != ErrStateModelDefExists {
+		t.Error("expect ErrStateModelDefExists")
+	}
+
+	got, err := a.GetStateModelDef(cluster, "Bootstrap")
+	if err != nil || !reflect.DeepEqual(got, def) {
+		t.Errorf("expect the same definition back, got %v %v", got, err)
+	}
+
+	// a state model used by a resource stays
+	if err := a.AddResource(cluster, "resource", 4, "Bootstrap"); err != nil {
+		t.Error(err)
+	}
+	if err := a.DropStateModelDef(cluster, "Bootstrap"); err != ErrStateModelDefInUse {
+		t.Error("expect ErrStateModelDefInUse")
+	}
+
+	a.DropResource(cluster, "resource")
+	if err := a.DropStateModelDef(cluster, "Bootstrap"); err != nil {
+		t.Error(err)
+	}
+	if _, err := a.GetStateModelDef(cluster, "Bootstrap"); err != ErrStateModelDefNotExist {
+		t.Error("expect ErrStateModelDefNotExist")
+	}
+}
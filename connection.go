@@ -4,33 +4,24 @@ import (
 	"path"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/yichen/go-zookeeper/zk"
-	"github.com/yichen/retry"
-)
-
-var (
-	zkRetryOptions = retry.RetryOptions{
-		"zookeeper",           // tag
-		time.Millisecond * 50, // backoff
-		time.Second * 1,       // max backoff
-		1,                     // default backoff constant
-		0,                     // infinit retry
-		false,                 // use V(1) level for log messages
-	}
 )
 
 type connection struct {
-	sync.RWMutex
-
 	servers     []string
 	chroot      string
 	isConnected bool
 
 	zkConn *zk.Conn
-	stat   *zk.Stat
+
+	// session events of the underlying zookeeper connection, such as
+	// disconnected, expired or a new session established
+	sessionEvents <-chan zk.Event
+
+	// how the reads are retried when they fail with a retriable error, such as a
+	// connection loss. The other errors, like a missing node, are returned right away.
+	retryPolicy RetryPolicy
 }
 
 func newConnection(zkSvr string) *connection {
@@ -41,20 +32,22 @@ func newConnection(zkSvr string) *connection {
 	}
 
 	conn := connection{
-		servers: servers,
-		chroot:  chroot,
+		servers:     servers,
+		chroot:      chroot,
+		retryPolicy: DefaultRetryPolicy,
 	}
 
 	return &conn
 }
 
 func (conn *connection) Connect() error {
-	zkConn, _, err := zk.Connect(conn.servers, zkSessionTimeout)
+	zkConn, sessionEvents, err := zk.Connect(conn.servers, zkSessionTimeout)
 	if err != nil {
 		return err
 	}
 
 	conn.zkConn = zkConn
+	conn.sessionEvents = sessionEvents
 	if err = conn.waitUntilConnected(); err != nil {
 		conn.zkConn = nil
 		return err
@@ -65,7 +58,7 @@ func (conn *connection) Connect() error {
 	return nil
 }
 
-func (conn connection) realPath(path string) string {
+func (conn *connection) realPath(path string) string {
 	if conn.chroot == "" {
 		return path
 	}
@@ -125,22 +118,29 @@ func (conn *connection) CreateRecordWithPath(p string, r *Record) error {
 
 func (conn *connection) Exists(path string) (bool, error) {
 	var result bool
-	var stat *zk.Stat
 
-	err := retry.RetryWithBackoff(zkRetryOptions, func() (retry.RetryStatus, error) {
-		r, s, err := conn.zkConn.Exists(conn.realPath(path))
-		if err != nil {
-			return retry.RetryContinue, nil
-		}
-		result = r
-		stat = s
-		return retry.RetryBreak, nil
+	err := conn.retryPolicy.do(func() (err error) {
+		result, _, err = conn.zkConn.Exists(conn.realPath(path))
+		return err
 	})
 
-	conn.stat = stat
 	return result, err
 }
 
+// ExistsW checks the existence of the path and leaves a watch on it. The watch fires
+// when the node is created, deleted or its data changes.
+func (conn *connection) ExistsW(path string) (bool, <-chan zk.Event, error) {
+	var result bool
+	var events <-chan zk.Event
+
+	err := conn.retryPolicy.do(func() (err error) {
+		result, _, events, err = conn.zkConn.ExistsW(conn.realPath(path))
+		return err
+	})
+
+	return result, events, err
+}
+
 func (conn *connection) ExistsAll(paths ...string) (bool, error) {
 	for _, path := range paths {
 		if exists, err := conn.Exists(path); err != nil || exists == false {
@@ -152,41 +152,39 @@ func (conn *connection) ExistsAll(paths ...string) (bool, error) {
 }
 
 func (conn *connection) Get(path string) ([]byte, error) {
+	data, _, err := conn.getWithStat(path)
+	return data, err
+}
+
+// getWithStat returns the data at the path along with its stat, such as its version.
+func (conn *connection) getWithStat(path string) ([]byte, *zk.Stat, error) {
 	var data []byte
+	var stat *zk.Stat
 
-	err := retry.RetryWithBackoff(zkRetryOptions, func() (retry.RetryStatus, error) {
-		d, s, err := conn.zkConn.Get(conn.realPath(path))
-		if err != nil {
-			return retry.RetryContinue, nil
-		}
-		data = d
-		conn.stat = s
-		return retry.RetryBreak, nil
+	err := conn.retryPolicy.do(func() (err error) {
+		data, stat, err = conn.zkConn.Get(conn.realPath(path))
+		return err
 	})
 
-	return data, err
+	return data, stat, err
 }
 
 func (conn *connection) GetW(path string) ([]byte, <-chan zk.Event, error) {
 	var data []byte
 	var events <-chan zk.Event
 
-	err := retry.RetryWithBackoff(zkRetryOptions, func() (retry.RetryStatus, error) {
-		d, s, evts, err := conn.zkConn.GetW(conn.realPath(path))
-		if err != nil {
-			return retry.RetryContinue, nil
-		}
-		data = d
-		conn.stat = s
-		events = evts
-		return retry.RetryBreak, nil
+	err := conn.retryPolicy.do(func() (err error) {
+		data, _, events, err = conn.zkConn.GetW(conn.realPath(path))
+		return err
 	})
 
 	return data, events, err
 }
 
-func (conn *connection) Set(path string, data []byte) error {
-	_, err := conn.zkConn.Set(conn.realPath(path), data, conn.stat.Version)
+// Set sets the data at the path if its version is still the given one, or whatever its
+// version is if -1.
+func (conn *connection) Set(path string, data []byte, version int32) error {
+	_, err := conn.zkConn.Set(conn.realPath(path), data, version)
 	return err
 }
 
@@ -197,14 +195,9 @@ func (conn *connection) Create(path string, data []byte, flags int32, acl []zk.A
 func (conn *connection) Children(path string) ([]string, error) {
 	var children []string
 
-	err := retry.RetryWithBackoff(zkRetryOptions, func() (retry.RetryStatus, error) {
-		c, s, err := conn.zkConn.Children(conn.realPath(path))
-		if err != nil {
-			return retry.RetryContinue, nil
-		}
-		children = c
-		conn.stat = s
-		return retry.RetryBreak, nil
+	err := conn.retryPolicy.do(func() (err error) {
+		children, _, err = conn.zkConn.Children(conn.realPath(path))
+		return err
 	})
 
 	return children, err
@@ -214,15 +207,9 @@ func (conn *connection) ChildrenW(path string) ([]string, <-chan zk.Event, error
 	var children []string
 	var eventChan <-chan zk.Event
 
-	err := retry.RetryWithBackoff(zkRetryOptions, func() (retry.RetryStatus, error) {
-		c, s, evts, err := conn.zkConn.ChildrenW(conn.realPath(path))
-		if err != nil {
-			return retry.RetryContinue, nil
-		}
-		children = c
-		conn.stat = s
-		eventChan = evts
-		return retry.RetryBreak, nil
+	err := conn.retryPolicy.do(func() (err error) {
+		children, _, eventChan, err = conn.zkConn.ChildrenW(conn.realPath(path))
+		return err
 	})
 
 	return children, eventChan, err
@@ -239,77 +226,42 @@ func (conn *connection) ChildrenW(path string) ([]string, <-chan zk.Event, error
 // if we want to set the CURRENT_STATE to ONLINE, we call
 // UpdateMapField("/RELAY/INSTANCES/{instance}/CURRENT_STATE/{sessionID}/{db}", "eat1-app993.stg.linkedin.com_11932,BizProfile,p31_1,SLAVE", "CURRENT_STATE", "ONLINE")
 func (conn *connection) UpdateMapField(path string, key string, property string, value string) error {
-	data, err := conn.Get(path) // Get itself handles chroot
-	if err != nil {
-		return err
-	}
-
-	// convert the result into Record
-	node, err := NewRecordFromBytes(data)
-	if err != nil {
-		return err
-	}
-
-	// update the value
-	node.SetMapField(key, property, value)
-
-	// mashall to bytes
-	data, err = node.Marshal()
-	if err != nil {
-		return err
-	}
-
-	// copy back to zookeeper
-	err = conn.Set(path, data)
-	return err
+	return conn.updateRecord(path, func(node *Record) {
+		node.SetMapField(key, property, value)
+	})
 }
 
 func (conn *connection) UpdateSimpleField(path string, key string, value string) error {
-	// get the current node
+	return conn.updateRecord(path, func(node *Record) {
+		node.SetSimpleField(key, value)
+	})
+}
+
+func (conn *connection) GetSimpleFieldValueByKey(path string, key string) (string, error) {
 	data, err := conn.Get(path)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// convert the result into Record
 	node, err := NewRecordFromBytes(data)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// update the value
-	node.SetSimpleField(key, value)
-
-	// mashall to bytes
-	data, err = node.Marshal()
-	if err != nil {
-		return err
-	}
-
-	// copy back to zookeeper
-	return conn.Set(path, data)
-}
-
-func (conn *connection) GetSimpleFieldValueByKey(path string, key string) string {
-	data, err := conn.Get(path)
-	must(err)
-
-	node, err := NewRecordFromBytes(data)
-	must(err)
-
 	if node.SimpleFields == nil {
-		return ""
+		return "", nil
 	}
 
 	v := node.GetSimpleField(key)
 	if v == nil {
-		return ""
+		return "", nil
 	}
-	return v.(string)
+	return v.(string), nil
 }
 
+// GetSimpleFieldBool returns false if the field is not "true", or cannot be read
 func (conn *connection) GetSimpleFieldBool(path string, key string) bool {
-	result := conn.GetSimpleFieldValueByKey(path, key)
+	result, _ := conn.GetSimpleFieldValueByKey(path, key)
 	return strings.ToUpper(result) == "TRUE"
 }
 
@@ -348,26 +300,9 @@ func (conn *connection) deleteTreeRealPath(path string) error {
 }
 
 func (conn *connection) RemoveMapFieldKey(path string, key string) error {
-	data, err := conn.Get(path)
-	if err != nil {
-		return err
-	}
-
-	node, err := NewRecordFromBytes(data)
-	if err != nil {
-		return err
-	}
-
-	node.RemoveMapField(key)
-
-	data, err = node.Marshal()
-	if err != nil {
-		return err
-	}
-
-	// save the data back to zookeeper
-	err = conn.Set(path, data)
-	return err
+	return conn.updateRecord(path, func(node *Record) {
+		node.RemoveMapField(key)
+	})
 }
 
 func (conn *connection) IsClusterSetup(cluster string) (bool, error) {
@@ -414,21 +349,73 @@ func (conn *connection) SetRecordForPath(path string, r *Record) error {
 	}
 
 	// need to get the stat.version before calling set
-	conn.Lock()
-
-	if _, err := conn.Get(path); err != nil {
-		conn.Unlock()
+	_, stat, err := conn.getWithStat(path)
+	if err != nil {
 		return err
 	}
 
-	if err := conn.Set(path, data); err != nil {
-		conn.Unlock()
+	return conn.Set(path, data, stat.Version)
+}
+
+// GetRecordWithVersion returns the record at the path along with its version, to
+// set it back later with SetRecordWithVersion.
+func (conn *connection) GetRecordWithVersion(path string) (*Record, int32, error) {
+	data, stat, err := conn.getWithStat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r, err := NewRecordFromBytes(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, stat.Version, nil
+}
+
+// SetRecordWithVersion sets the record at the path only if its version is still the
+// given one. It returns zk.ErrBadVersion if the record was changed in the meantime.
+func (conn *connection) SetRecordWithVersion(path string, r *Record, version int32) error {
+	data, err := r.Marshal()
+	if err != nil {
 		return err
 	}
 
-	conn.Unlock()
-	return nil
+	_, err = conn.zkConn.Set(conn.realPath(path), data, version)
+	return err
+}
+
+// updateRecord applies the update to the record at the path and writes it back. If the
+// record is changed by someone else in the meantime, the update is applied again on top
+// of the new record, so that concurrent updates to different fields are not lost.
+func (conn *connection) updateRecord(path string, update func(node *Record)) error {
+	for {
+		node, version, err := conn.GetRecordWithVersion(path)
+		if err != nil {
+			return err
+		}
+
+		update(node)
+
+		err = conn.SetRecordWithVersion(path, node, version)
+		if err != zk.ErrBadVersion {
+			return err
+		}
+	}
+}
 
+// OverwriteRecordForPath sets the record at the path whatever its version is, and
+// creates the path if it does not exist yet.
+func (conn *connection) OverwriteRecordForPath(p string, r *Record) error {
+	data, err := r.Marshal()
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.zkConn.Set(conn.realPath(p), data, -1)
+	if err == zk.ErrNoNode {
+		return conn.CreateRecordWithPath(p, r)
+	}
+	return err
 }
 
 // EnsurePath makes sure the specified path exists.
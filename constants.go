@@ -12,6 +12,7 @@ const (
 	instanceConfigChanged     changeNotificationType = 4
 	controllerMessagesChanged changeNotificationType = 5
 	instanceMessagesChanged   changeNotificationType = 6
+	controllerLeaderChanged   changeNotificationType = 7
 )
 
 const (
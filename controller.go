@@ -1,3 +1,432 @@
 package gohelix
 
-type Controller struct{}
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yichen/go-zookeeper/zk"
+)
+
+type controllerState uint8
+
+const (
+	controllerConnected    controllerState = 0
+	controllerStarted      controllerState = 1
+	controllerStopped      controllerState = 2
+	controllerDisconnected controllerState = 3
+)
+
+// Controller is the Helix role that drives the cluster toward its ideal state.
+// Any number of controllers can connect to a cluster, but only the one holding the
+// ephemeral /{cluster}/CONTROLLER/LEADER znode runs the controller pipeline. The
+// others stand by and take over when the leader goes away.
+type Controller struct {
+	// HelixManager
+	conn *connection
+
+	// zookeeper connection string
+	zkSvr string
+
+	// The cluster this controller manages
+	ClusterID string
+
+	// ControllerID is the identifier of this controller, by default to hostname_pid
+	ControllerID string
+
+	// keybuilder
+	kb keyBuilder
+
+	// the ephemeral znode held by the leader
+	leaderPath string
+
+	// the stages that run, in order, whenever the leader sees a cluster change
+	pipeline []pipelineStage
+
+	// the current leadership term, nil if this controller is not the leader
+	term *leaderTerm
+
+	// closed to stop the election loop, which closes stopped once it returns
+	stop    chan bool
+	stopped chan struct{}
+
+	// status, guarded by the mutex
+	state controllerState
+
+	sync.RWMutex
+}
+
+// pipelineStage is one step of the controller pipeline. A stage returning
+// an error aborts the rest of the pipeline run.
+type pipelineStage func(c *Controller, event *clusterEvent) error
+
+// clusterEvent carries the data shared by the stages of one pipeline run.
+type clusterEvent struct {
+	trigger changeNotificationType
+	term    *leaderTerm
+
+	// snapshot of the cluster read by the first stage
+	cache *clusterDataCache
+
+	// resource -> partition -> instance -> state
+	bestPossibleState map[string]map[string]map[string]string
+}
+
+// leaderTerm holds the watchers and the change notifications of one leadership
+// term. Everything started within the term stops when the leadership is lost.
+type leaderTerm struct {
+	// closed when the leadership is lost
+	stop chan bool
+
+	// changes observed by the watchers of this term
+	changeNotificationChan chan changeNotification
+
+	// paths being watched, to avoid watching the same path twice
+	watches map[string]bool
+
+	sync.Mutex
+}
+
+func newLeaderTerm() *leaderTerm {
+	return &leaderTerm{
+		stop:                   make(chan bool),
+		changeNotificationChan: make(chan changeNotification, 1000),
+		watches:                map[string]bool{},
+	}
+}
+
+// addWatch marks the path as watched. It returns false if the path is already watched.
+func (t *leaderTerm) addWatch(path string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.watches[path] {
+		return false
+	}
+	t.watches[path] = true
+	return true
+}
+
+func (t *leaderTerm) removeWatch(path string) {
+	t.Lock()
+	delete(t.watches, path)
+	t.Unlock()
+}
+
+// notify queues a change notification for the pipeline. If the queue is full, a
+// pipeline run is pending anyway and the notification can be dropped.
+func (t *leaderTerm) notify(chg changeNotification) {
+	select {
+	case t.changeNotificationChan <- chg:
+	default:
+	}
+}
+
+func defaultControllerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return fmt.Sprintf("%s_%d", hostname, os.Getpid())
+}
+
+// Connect the controller to zookeeper and join the leader election of the cluster.
+func (c *Controller) Connect() error {
+	if c.conn != nil && c.conn.IsConnected() {
+		return nil
+	}
+
+	c.conn = newConnection(c.zkSvr)
+	if err := c.conn.Connect(); err != nil {
+		return err
+	}
+
+	if ok, err := c.conn.IsClusterSetup(c.ClusterID); !ok || err != nil {
+		c.conn.Disconnect()
+		return ErrClusterNotSetup
+	}
+
+	c.setState(controllerConnected)
+	c.startElectionLoop()
+
+	return nil
+}
+
+func (c *Controller) getState() controllerState {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.state
+}
+
+func (c *Controller) setState(state controllerState) {
+	c.Lock()
+	c.state = state
+	c.Unlock()
+}
+
+// Disconnect the controller. If it is the leader, the pipeline stops and the leader
+// znode goes away with the zookeeper session so that a standby controller takes over.
+func (c *Controller) Disconnect() {
+	state := c.getState()
+	if state == controllerDisconnected {
+		return
+	}
+
+	if state == controllerStarted {
+		close(c.stop)
+		<-c.stopped
+	}
+
+	if c.conn.IsConnected() {
+		c.conn.Disconnect()
+	}
+
+	c.setState(controllerDisconnected)
+}
+
+// IsLeader tells whether this controller is currently the leader of the cluster.
+func (c *Controller) IsLeader() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.term != nil
+}
+
+// startElectionLoop keeps the controller in the leader election until it is stopped.
+// Every time the leader znode changes, or the zookeeper session expires, the election
+// runs again.
+func (c *Controller) startElectionLoop() {
+	c.stop = make(chan bool)
+	c.stopped = make(chan struct{})
+	c.setState(controllerStarted)
+
+	go func() {
+		defer func() {
+			c.resign()
+			c.setState(controllerStopped)
+			close(c.stopped)
+		}()
+
+		for {
+			leader, err := c.tryAcquireLeadership()
+			if err != nil {
+				Logger.Printf("Controller %s failed to run leader election: %s\n", c.ControllerID, err.Error())
+
+				// back off a little, the zookeeper session might be reestablishing
+				select {
+				case <-time.After(time.Second):
+					continue
+				case <-c.stop:
+					return
+				}
+			}
+
+			if leader {
+				c.becomeLeader()
+			} else {
+				c.resign()
+			}
+
+			exists, events, _ := c.conn.ExistsW(c.leaderPath)
+			if !exists {
+				// the leader just went away, run the election again
+				continue
+			}
+
+			if !c.waitForLeaderChange(events) {
+				return
+			}
+		}
+	}()
+}
+
+// tryAcquireLeadership creates the ephemeral leader znode. It returns true if this
+// controller is the leader after the attempt.
+func (c *Controller) tryAcquireLeadership() (bool, error) {
+	path := c.leaderPath
+	sessionID := c.conn.GetSessionID()
+
+	node := NewLiveInstanceNode(c.ControllerID, sessionID)
+	data, err := node.Marshal()
+	if err != nil {
+		return false, err
+	}
+
+	flags := int32(zk.FlagEphemeral)
+	acl := zk.WorldACL(zk.PermAll)
+
+	_, err = c.conn.Create(path, data, flags, acl)
+	if err == nil {
+		return true, nil
+	}
+	if err != zk.ErrNodeExists {
+		return false, err
+	}
+
+	// the leader znode exists. It is still ours if it was created by an earlier
+	// election in this same session
+	data, err = c.conn.Get(path)
+	if err == zk.ErrNoNode {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	leader, err := NewRecordFromBytes(data)
+	if err != nil {
+		return false, err
+	}
+
+	return leader.GetSimpleField("SESSION_ID") == sessionID, nil
+}
+
+// waitForLeaderChange blocks until the leader znode changes, the zookeeper session expires
+// or the controller is stopped. It returns false if the controller is stopped.
+func (c *Controller) waitForLeaderChange(leaderEvents <-chan zk.Event) bool {
+	for {
+		select {
+		case <-leaderEvents:
+			return true
+
+		case evt := <-c.conn.sessionEvents:
+			if evt.State == zk.StateExpired {
+				// the ephemeral leader znode is gone with the session, and so is the
+				// leadership. The election runs again once a new session is established.
+				Logger.Printf("Controller %s session expired\n", c.ControllerID)
+				c.resign()
+				return true
+			}
+
+		case <-c.stop:
+			return false
+		}
+	}
+}
+
+func (c *Controller) becomeLeader() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.term != nil {
+		return
+	}
+
+	Logger.Printf("Controller %s becomes the leader of cluster %s\n", c.ControllerID, c.ClusterID)
+
+	c.term = newLeaderTerm()
+	c.startPipeline(c.term)
+}
+
+func (c *Controller) resign() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.term == nil {
+		return
+	}
+
+	Logger.Printf("Controller %s is no longer the leader of cluster %s\n", c.ControllerID, c.ClusterID)
+
+	close(c.term.stop)
+	c.term = nil
+}
+
+// startPipeline watches the cluster for changes, and runs the pipeline for every
+// change until the leadership term ends.
+func (c *Controller) startPipeline(term *leaderTerm) {
+	c.watchChildren(term, c.kb.liveInstances(), liveInstanceChanged)
+	c.watchChildren(term, c.kb.idealStates(), idealStateChanged)
+
+	go func() {
+		// catch up with whatever changed while no controller was leading
+		c.runPipeline(term, controllerLeaderChanged)
+
+		for {
+			select {
+			case chg := <-term.changeNotificationChan:
+				// the pipeline works on a fresh snapshot of the cluster, so all
+				// notifications queued so far are handled by a single run
+				for pending := true; pending; {
+					select {
+					case <-term.changeNotificationChan:
+					default:
+						pending = false
+					}
+				}
+				c.runPipeline(term, chg.changeType)
+
+			case <-term.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *Controller) runPipeline(term *leaderTerm, trigger changeNotificationType) {
+	event := &clusterEvent{trigger: trigger, term: term}
+	for _, stage := range c.pipeline {
+		if err := stage(c, event); err != nil {
+			Logger.Printf("Controller %s pipeline aborted: %s\n", c.ControllerID, err.Error())
+			return
+		}
+	}
+}
+
+// watchChildren notifies the pipeline whenever the children of the path change,
+// until the path is deleted or the leadership term ends.
+func (c *Controller) watchChildren(term *leaderTerm, path string, changeType changeNotificationType) {
+	if !term.addWatch(path) {
+		return
+	}
+
+	go func() {
+		defer term.removeWatch(path)
+
+		for {
+			_, events, err := c.conn.ChildrenW(path)
+			if err != nil {
+				if err != zk.ErrNoNode {
+					Logger.Printf("Controller %s failed to watch %s: %s\n", c.ControllerID, path, err.Error())
+				}
+				return
+			}
+
+			select {
+			case <-events:
+				term.notify(changeNotification{changeType, path})
+			case <-term.stop:
+				return
+			}
+		}
+	}()
+}
+
+// watchData notifies the pipeline whenever the data of the path changes, until
+// the path is deleted or the leadership term ends.
+func (c *Controller) watchData(term *leaderTerm, path string, changeType changeNotificationType) {
+	if !term.addWatch(path) {
+		return
+	}
+
+	go func() {
+		defer term.removeWatch(path)
+
+		for {
+			exists, events, err := c.conn.ExistsW(path)
+			if err != nil || !exists {
+				return
+			}
+
+			select {
+			case <-events:
+				term.notify(changeNotification{changeType, path})
+			case <-term.stop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,75 @@
+package gohelix
+
+import (
+	"testing"
+	"time"
+)
+
+// waitUntil polls the condition until it holds or the timeout expires
+func waitUntil(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+func TestControllerFailover(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "controller_test_TestControllerFailover_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+
+	manager := NewHelixManager(testZkSvr)
+	c1 := manager.NewController(cluster)
+	c1.ControllerID = "controller_1"
+	c2 := manager.NewController(cluster)
+	c2.ControllerID = "controller_2"
+
+	if err := c1.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Disconnect()
+
+	if !waitUntil(5*time.Second, c1.IsLeader) {
+		t.Fatal("expect controller_1 to become the leader")
+	}
+
+	if err := c2.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Disconnect()
+
+	time.Sleep(500 * time.Millisecond)
+	if c2.IsLeader() {
+		t.Error("expect controller_2 to stand by while controller_1 leads")
+	}
+
+	// controller_1 loses the leadership with its session, and controller_2 takes over
+	c1.Disconnect()
+	if c1.IsLeader() {
+		t.Error("expect controller_1 to resign once disconnected")
+	}
+
+	if !waitUntil(10*time.Second, c2.IsLeader) {
+		t.Fatal("expect controller_2 to take over the leadership")
+	}
+
+	leader, err := c2.conn.GetRecordFromPath(c2.kb.controllerLeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader.GetStringField("SESSION_ID", "") != c2.conn.GetSessionID() {
+		t.Errorf("expect the leader znode of controller_2, got %s", leader)
+	}
+
+	// disconnecting twice is harmless
+	c1.Disconnect()
+}
@@ -0,0 +1,51 @@
+package gohelix
+
+// customizedRebalancer drives each partition toward the exact assignment kept in the ideal
+// state mapFields, as partition -> instance -> state. Instances that are not alive are
+// skipped, and the controller still walks each instance through the transitions of the
+// state model, e.g. OFFLINE->SLAVE->MASTER, one hop at a time.
+type customizedRebalancer struct{}
+
+func (r customizedRebalancer) computeBestPossibleState(resource string, idealState *Record, def *StateModelDefinition, cache *clusterDataCache) map[string]map[string]string {
+	result := map[string]map[string]string{}
+
+	for _, partition := range cache.partitions(resource, idealState) {
+		states := map[string]string{}
+
+		for instance, state := range idealState.MapFields[partition] {
+			if _, live := cache.liveInstances[instance]; !live {
+				continue
+			}
+
+			if !strSliceContains(def.States, state) {
+				Logger.Printf("State %s of %s on %s is not in state model %s\n", state, partition, instance, def.Name)
+				continue
+			}
+
+			switch {
+			case cache.currentState(instance, resource, partition) == "ERROR":
+				// a partition in ERROR stays there until it is reset
+				states[instance] = "ERROR"
+			case !cache.isInstanceEnabled(instance):
+				states[instance] = def.InitialState
+			default:
+				states[instance] = state
+			}
+		}
+
+		// live instances holding the partition without being assigned are dropped
+		for instance := range cache.liveInstances {
+			if _, ok := states[instance]; ok {
+				continue
+			}
+
+			if current := cache.currentState(instance, resource, partition); current != "" && current != "DROPPED" {
+				states[instance] = "DROPPED"
+			}
+		}
+
+		result[partition] = states
+	}
+
+	return result
+}
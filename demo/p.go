@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/funkygao/gohelix"
 )
@@ -45,14 +47,15 @@ func main() {
 	log.Printf("resource[%s] partitions:%d model:%s added to cluster[%s]", resource,
 		partitions, stateModel, cluster)
 
+	manager := gohelix.NewHelixManager(zkSvr)
+
 	// start contoller
-	go func() {
-		err = gohelix.StartController(cluster)
-		must(err)
-	}()
+	controller := manager.NewController(cluster)
+	err = controller.Connect()
+	must(err)
+	defer controller.Disconnect()
 	log.Println("controller started")
 
-	manager := gohelix.NewHelixManager(zkSvr)
 	participant := manager.NewParticipant(cluster, "localhost", "10925")
 	participant.AddPreConnectCallback(func() {
 		log.Println("participant trying conn...")
@@ -66,9 +69,13 @@ func main() {
 		{"OFFLINE", "ONLINE", func(partition string) {
 			log.Println("OFFLINE-->ONLINE")
 		}},
+		{"OFFLINE", "DROPPED", func(partition string) {
+			log.Println("OFFLINE-->DROPPED")
+		}},
 	})
 
 	participant.RegisterStateModel(stateModel, sm)
+	participant.SetOfflineOnShutdown(true)
 
 	err = participant.Connect()
 	must(err)
@@ -77,10 +84,8 @@ func main() {
 	instances, _ := admin.GetInstances(cluster)
 	log.Printf("instances: %+v", instances)
 
-	go func() {
-		err = gohelix.Rebalance(cluster, resource, "2")
-		must(err)
-	}()
+	err = admin.Rebalance(cluster, resource, 2)
+	must(err)
 	log.Println("rebalanced")
 
 	log.Println("waiting Ctrl-C...")
@@ -89,4 +94,11 @@ func main() {
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err = participant.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	log.Println("participant shutdown")
 }
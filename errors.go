@@ -26,6 +26,21 @@ var (
 
 	// ErrResourceNotExists the resource does not exists and cannot be removed
 	ErrResourceNotExists = errors.New("resource not exists in cluster")
+
+	// ErrStateModelDefExists the state model definition already exists in the cluster
+	ErrStateModelDefExists = errors.New("state model already exists in cluster")
+
+	// ErrStateModelDefInUse the state model definition is used by resources of the cluster
+	ErrStateModelDefInUse = errors.New("state model is used by resources in cluster")
+
+	// ErrInvalidStateModelDef the state model definition is not consistent
+	ErrInvalidStateModelDef = errors.New("invalid state model definition")
+
+	// ErrInvalidReplicas the number of replicas is not a positive number
+	ErrInvalidReplicas = errors.New("invalid number of replicas")
+
+	// ErrNotEnoughInstances there are fewer enabled instances than replicas to place
+	ErrNotEnoughInstances = errors.New("not enough instances in cluster")
 )
 
 var (
@@ -34,4 +49,47 @@ var (
 	ErrEnsureParticipantConfig = errors.New("Participant configuration could not be added")
 
 	ErrInvalidAddResourceOption = errors.New("Invalid AddResourceOption")
+
+	// ErrInstanceNotAlive the instance is expected to be in the live instances
+	ErrInstanceNotAlive = errors.New("instance is not alive")
+
+	// ErrPartitionNotInError the partition to reset is not in the ERROR state
+	ErrPartitionNotInError = errors.New("partition is not in ERROR state")
+
+	// ErrTransitionNotRegistered the participant has no handler registered for the state
+	// transition of a message
+	ErrTransitionNotRegistered = errors.New("state transition not registered")
+
+	// ErrUnknownDiagramFormat a state model definition can only be rendered as dot or mermaid
+	ErrUnknownDiagramFormat = errors.New("unknown diagram format")
+
+	// ErrIllegalTransition the state transition of a message is not a single hop of its
+	// state model definition
+	ErrIllegalTransition = errors.New("illegal state transition")
+
+	// ErrTransitionTimeout the state transition did not complete within the TIMEOUT of its message
+	ErrTransitionTimeout = errors.New("state transition timed out")
+
+	// ErrTransitionCancelled the state transition was cancelled by a cancellation message
+	ErrTransitionCancelled = errors.New("state transition cancelled")
+
+	// ErrTransitionVetoed the state transition was turned down by a transition interceptor
+	ErrTransitionVetoed = errors.New("state transition vetoed")
+
+	// ErrInvalidStateModel the state model registered by the participant does not match
+	// its definition in the cluster
+	ErrInvalidStateModel = errors.New("invalid state model")
+
+	// ErrParticipantNotConnected the participant must be connected to do this
+	ErrParticipantNotConnected = errors.New("participant not connected")
+
+	// ErrMessageHandlerNotRegistered the participant has no handler registered for the
+	// type of a user defined message
+	ErrMessageHandlerNotRegistered = errors.New("message handler not registered")
+
+	// ErrMessageNotSent the message could not be sent to some of its targets
+	ErrMessageNotSent = errors.New("message not sent to all targets")
+
+	// ErrReplyTimeout some targets did not reply to the message in time
+	ErrReplyTimeout = errors.New("timed out waiting for replies")
 )
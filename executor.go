@@ -0,0 +1,174 @@
+package gohelix
+
+import (
+	"context"
+	"sync"
+)
+
+// messageTask is a message waiting to be processed by the participant
+type messageTask struct {
+	msgID     string
+	resource  string
+	partition string
+
+	process func()
+}
+
+// key identifies what the task changes. Tasks with the same key run one after the
+// other, in the order they are submitted.
+func (t *messageTask) key() string {
+	if t.partition == "" {
+		return t.msgID
+	}
+	return t.resource + "/" + t.partition
+}
+
+// messageExecutor runs the message tasks of the participant on a bounded number of
+// goroutines. The transitions of different partitions run in parallel, while those of
+// the same partition run in order, and each resource can be limited on its own.
+type messageExecutor struct {
+	maxWorkers int
+
+	// resource -> maximum number of tasks of the resource running at the same time
+	resourceLimits map[string]int
+
+	// tasks not started yet, in the order they are submitted
+	pending []*messageTask
+
+	// the messages pending or running, so that the same message is not submitted twice
+	messages map[string]bool
+
+	running          int
+	runningKeys      map[string]bool
+	runningResources map[string]int
+
+	// set once stopped, and closed when the last running task is done
+	stopped bool
+	idle    chan struct{}
+
+	sync.Mutex
+}
+
+func newMessageExecutor(maxWorkers int, resourceLimits map[string]int) *messageExecutor {
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+
+	limits := map[string]int{}
+	for resource, limit := range resourceLimits {
+		limits[resource] = limit
+	}
+
+	return &messageExecutor{
+		maxWorkers:       maxWorkers,
+		resourceLimits:   limits,
+		messages:         map[string]bool{},
+		runningKeys:      map[string]bool{},
+		runningResources: map[string]int{},
+		idle:             make(chan struct{}),
+	}
+}
+
+// submit queues the task. It returns false if the message of the task is already
+// pending or running.
+func (e *messageExecutor) submit(task *messageTask) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.stopped || e.messages[task.msgID] {
+		return false
+	}
+
+	e.messages[task.msgID] = true
+	e.pending = append(e.pending, task)
+	e.schedule()
+
+	return true
+}
+
+// schedule starts the pending tasks that can run now. It must be called with the lock held.
+func (e *messageExecutor) schedule() {
+	// tasks with the same key queued behind a task that cannot start must wait too
+	blocked := map[string]bool{}
+
+	pending := e.pending[:0]
+	for _, task := range e.pending {
+		key := task.key()
+		if e.running >= e.maxWorkers || blocked[key] || e.runningKeys[key] || !e.resourceAvailable(task.resource) {
+			blocked[key] = true
+			pending = append(pending, task)
+			continue
+		}
+
+		e.running++
+		e.runningKeys[key] = true
+		e.runningResources[task.resource]++
+
+		go e.run(task)
+	}
+	e.pending = pending
+}
+
+func (e *messageExecutor) resourceAvailable(resource string) bool {
+	limit, ok := e.resourceLimits[resource]
+	return !ok || limit < 1 || e.runningResources[resource] < limit
+}
+
+func (e *messageExecutor) run(task *messageTask) {
+	defer func() {
+		e.Lock()
+		defer e.Unlock()
+
+		e.running--
+		delete(e.runningKeys, task.key())
+		e.runningResources[task.resource]--
+		if e.runningResources[task.resource] == 0 {
+			delete(e.runningResources, task.resource)
+		}
+		delete(e.messages, task.msgID)
+
+		if e.stopped {
+			if e.running == 0 {
+				close(e.idle)
+			}
+			return
+		}
+		e.schedule()
+	}()
+
+	task.process()
+}
+
+// stop refuses the tasks submitted from now on, and returns the pending tasks, which are
+// dropped. The running tasks go on until they are done, see wait.
+func (e *messageExecutor) stop() []*messageTask {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.stopped {
+		return nil
+	}
+	e.stopped = true
+
+	dropped := e.pending
+	e.pending = nil
+	for _, task := range dropped {
+		delete(e.messages, task.msgID)
+	}
+
+	if e.running == 0 {
+		close(e.idle)
+	}
+
+	return dropped
+}
+
+// wait blocks until the running tasks of the stopped executor are done, or the ctx is done.
+func (e *messageExecutor) wait(ctx context.Context) error {
+	select {
+	case <-e.idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
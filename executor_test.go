@@ -0,0 +1,146 @@
+package gohelix
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMessageExecutorPartitionOrder(t *testing.T) {
+	t.Parallel()
+
+	e := newMessageExecutor(4, nil)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	order := []string{}
+
+	for _, msgID := range []string{"m1", "m2", "m3"} {
+		msgID := msgID
+		wg.Add(1)
+		e.submit(&messageTask{msgID: msgID, resource: "db", partition: "db_0", process: func() {
+			defer wg.Done()
+			time.Sleep(10 * time.Millisecond)
+
+			lock.Lock()
+			order = append(order, msgID)
+			lock.Unlock()
+		}})
+	}
+	wg.Wait()
+
+	if len(order) != 3 || order[0] != "m1" || order[1] != "m2" || order[2] != "m3" {
+		t.Errorf("expect the messages of a partition in order, got %v", order)
+	}
+}
+
+func TestMessageExecutorConcurrency(t *testing.T) {
+	t.Parallel()
+
+	e := newMessageExecutor(3, map[string]int{"db": 1})
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	running := map[string]int{}
+	maxRunning := map[string]int{}
+
+	partitions := map[string][]string{
+		"db":    {"db_0", "db_1", "db_2"},
+		"cache": {"cache_0", "cache_1", "cache_2", "cache_3"},
+	}
+	for resource, list := range partitions {
+		for _, partition := range list {
+			resource := resource
+			wg.Add(1)
+			e.submit(&messageTask{msgID: partition, resource: resource, partition: partition, process: func() {
+				defer wg.Done()
+
+				lock.Lock()
+				running[resource]++
+				running[""]++
+				if running[resource] > maxRunning[resource] {
+					maxRunning[resource] = running[resource]
+				}
+				if running[""] > maxRunning[""] {
+					maxRunning[""] = running[""]
+				}
+				lock.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				lock.Lock()
+				running[resource]--
+				running[""]--
+				lock.Unlock()
+			}})
+		}
+	}
+	wg.Wait()
+
+	if maxRunning["db"] != 1 {
+		t.Errorf("expect at most 1 transition of db at a time, got %d", maxRunning["db"])
+	}
+	if maxRunning["cache"] < 2 {
+		t.Errorf("expect transitions of cache in parallel, got %d", maxRunning["cache"])
+	}
+	if maxRunning[""] > 3 {
+		t.Errorf("expect at most 3 transitions at a time, got %d", maxRunning[""])
+	}
+}
+
+func TestMessageExecutorDuplicate(t *testing.T) {
+	t.Parallel()
+
+	e := newMessageExecutor(1, nil)
+
+	release := make(chan bool)
+	done := make(chan bool)
+	task := &messageTask{msgID: "m1", resource: "db", partition: "db_0", process: func() {
+		<-release
+		done <- true
+	}}
+
+	if !e.submit(task) {
+		t.Error("expect the message to be submitted")
+	}
+	if e.submit(task) {
+		t.Error("expect the message running to be rejected")
+	}
+
+	close(release)
+	<-done
+}
+
+func TestMessageExecutorStop(t *testing.T) {
+	t.Parallel()
+
+	e := newMessageExecutor(1, nil)
+
+	release := make(chan bool)
+	e.submit(&messageTask{msgID: "m1", resource: "db", partition: "db_0", process: func() {
+		<-release
+	}})
+	e.submit(&messageTask{msgID: "m2", resource: "db", partition: "db_1", process: func() {
+		t.Error("expect the pending task dropped")
+	}})
+
+	dropped := e.stop()
+	if len(dropped) != 1 || dropped[0].msgID != "m2" {
+		t.Errorf("expect m2 dropped, got %v", dropped)
+	}
+	if e.submit(&messageTask{msgID: "m3", process: func() {}}) {
+		t.Error("expect no task submitted once stopped")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := e.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expect to wait for the running task, got %v", err)
+	}
+
+	close(release)
+	if err := e.wait(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,78 @@
+package gohelix
+
+// the ideal state fields copied to the external view of the resource
+var externalViewSimpleFields = []string{
+	"BUCKET_SIZE",
+	"NUM_PARTITIONS",
+	"REBALANCE_MODE",
+	"REPLICAS",
+	"STATE_MODEL_DEF_REF",
+	"STATE_MODEL_FACTORY_NAME",
+}
+
+// externalViewStage aggregates the current states of the live instances into the
+// external view of every resource. Only the views that changed are written back, and
+// the views of the resources dropped from the ideal states are removed.
+func externalViewStage(c *Controller, event *clusterEvent) error {
+	cache := event.cache
+	views := computeExternalViews(cache)
+
+	for resource, view := range views {
+		if existing, ok := cache.externalViews[resource]; ok && existing.String() == view.String() {
+			continue
+		}
+
+		if err := c.conn.OverwriteRecordForPath(c.kb.externalViewForResource(resource), view); err != nil {
+			return err
+		}
+	}
+
+	for resource := range cache.externalViews {
+		if _, ok := views[resource]; ok {
+			continue
+		}
+
+		if err := c.conn.DeleteTree(c.kb.externalViewForResource(resource)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// computeExternalViews returns the external view of every resource in the ideal states,
+// as mapFields of partition -> instance -> state held by the live instances.
+func computeExternalViews(cache *clusterDataCache) map[string]*Record {
+	views := map[string]*Record{}
+
+	for resource, idealState := range cache.idealStates {
+		view := NewRecord(resource)
+		for _, key := range externalViewSimpleFields {
+			if value := idealState.GetSimpleField(key); value != nil {
+				view.SetSimpleField(key, value)
+			}
+		}
+
+		views[resource] = view
+	}
+
+	for instance, resources := range cache.currentStates {
+		for resource, cs := range resources {
+			view, ok := views[resource]
+			if !ok {
+				continue
+			}
+
+			for partition, fields := range cs.MapFields {
+				state := fields["CURRENT_STATE"]
+				if state == "" || state == "DROPPED" {
+					continue
+				}
+
+				view.SetMapField(partition, instance, state)
+			}
+		}
+	}
+
+	return views
+}
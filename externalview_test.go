@@ -0,0 +1,39 @@
+package gohelix
+
+import (
+	"testing"
+)
+
+func TestComputeExternalViews(t *testing.T) {
+	t.Parallel()
+
+	cache := getTestClusterDataCache("a", "b")
+
+	is := NewRecord("db")
+	is.SetIntField("NUM_PARTITIONS", 2)
+	is.SetSimpleField("STATE_MODEL_DEF_REF", StateModelMasterSlave)
+	cache.idealStates["db"] = is
+
+	setTestCurrentState(cache, "a", "db", "db_0", "MASTER")
+	setTestCurrentState(cache, "b", "db", "db_0", "SLAVE")
+	setTestCurrentState(cache, "b", "db", "db_1", "DROPPED")
+
+	// a resource no longer in the ideal states has no external view
+	setTestCurrentState(cache, "a", "gone", "gone_0", "SLAVE")
+
+	views := computeExternalViews(cache)
+	if len(views) != 1 {
+		t.Fatalf("expect 1 external view, got %d", len(views))
+	}
+
+	ev := views["db"]
+	if ev.GetMapField("db_0", "a") != "MASTER" || ev.GetMapField("db_0", "b") != "SLAVE" {
+		t.Error("wrong external view for db_0")
+	}
+	if _, ok := ev.MapFields["db_1"]; ok {
+		t.Error("dropped partition should not be in the external view")
+	}
+	if ev.GetIntField("NUM_PARTITIONS", 0) != 2 || ev.GetStringField("STATE_MODEL_DEF_REF", "") != StateModelMasterSlave {
+		t.Error("ideal state fields are not copied")
+	}
+}
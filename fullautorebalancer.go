@@ -0,0 +1,176 @@
+package gohelix
+
+import (
+	"fmt"
+	"sort"
+)
+
+// fullAutoRebalancer places the partitions of the resource and their replicas on the live
+// and enabled instances by itself. Replicas stay where they are as long as the placement
+// is balanced, so only the excess moves when instances join, and only the replicas of the
+// instances leaving move when they leave.
+type fullAutoRebalancer struct{}
+
+func (r fullAutoRebalancer) computeBestPossibleState(resource string, idealState *Record, def *StateModelDefinition, cache *clusterDataCache) map[string]map[string]string {
+	preferenceLists := computeFullAutoPreferenceLists(resource, idealState, def, cache)
+
+	// partitions beyond NUM_PARTITIONS have no preference list and are dropped
+	for _, partition := range cache.partitions(resource, nil) {
+		if _, ok := preferenceLists[partition]; !ok {
+			preferenceLists[partition] = nil
+		}
+	}
+
+	result := map[string]map[string]string{}
+	for partition, preferenceList := range preferenceLists {
+		result[partition] = computeStatesFromPreferenceList(resource, partition, preferenceList, len(preferenceList), def, cache)
+	}
+
+	return result
+}
+
+// computeFullAutoPreferenceLists places REPLICAS replicas of each of the NUM_PARTITIONS
+// partitions, named {resource}_{index}, on the live and enabled instances. No instance
+// takes more than its share of the replicas, nor more than MAX_PARTITIONS_PER_INSTANCE.
+// The first instance of each list, which gets the top state, is spread evenly too.
+func computeFullAutoPreferenceLists(resource string, idealState *Record, def *StateModelDefinition, cache *clusterDataCache) map[string][]string {
+	result := map[string][]string{}
+
+	instances := []string{}
+	for instance := range cache.liveInstances {
+		if cache.isInstanceEnabled(instance) {
+			instances = append(instances, instance)
+		}
+	}
+	sort.Strings(instances)
+
+	numPartitions := idealState.GetIntField("NUM_PARTITIONS", 0)
+	if len(instances) == 0 || numPartitions < 1 {
+		return result
+	}
+
+	// at least one replica, and a state counted as "N" goes to every instance
+	replicas := cache.replicas(idealState)
+	if replicas < 1 {
+		replicas = 1
+	}
+	for _, state := range def.States {
+		if def.StateCounts[state] == "N" {
+			replicas = len(instances)
+		}
+	}
+	if replicas > len(instances) {
+		replicas = len(instances)
+	}
+
+	capacity := (numPartitions*replicas + len(instances) - 1) / len(instances)
+	if maxPartitions := idealState.GetIntField("MAX_PARTITIONS_PER_INSTANCE", 0); maxPartitions > 0 && maxPartitions < capacity {
+		capacity = maxPartitions
+	}
+
+	partitions := make([]string, numPartitions)
+	for i := range partitions {
+		partitions[i] = fmt.Sprintf("%s_%d", resource, i)
+	}
+
+	// replicas per instance, and top states per instance
+	load := map[string]int{}
+	topLoad := map[string]int{}
+
+	// keep the replicas where they are. The holders of the highest states are kept first,
+	// all partitions round after round, so that an instance over its share of the replicas
+	// sheds its lowest states
+	holders := map[string][]string{}
+	for _, partition := range partitions {
+		for _, instance := range instances {
+			state := cache.currentState(instance, resource, partition)
+			if state != "" && state != "DROPPED" && state != "ERROR" {
+				holders[partition] = append(holders[partition], instance)
+			}
+		}
+
+		h := holders[partition]
+		sort.SliceStable(h, func(i, j int) bool {
+			return def.statePriority(cache.currentState(h[i], resource, partition)) <
+				def.statePriority(cache.currentState(h[j], resource, partition))
+		})
+	}
+
+	for rank := 0; rank < replicas; rank++ {
+		for _, partition := range partitions {
+			for len(result[partition]) == rank && len(holders[partition]) > 0 {
+				instance := holders[partition][0]
+				holders[partition] = holders[partition][1:]
+
+				if load[instance] < capacity {
+					result[partition] = append(result[partition], instance)
+					load[instance]++
+				}
+			}
+		}
+	}
+
+	for _, preferenceList := range result {
+		topLoad[preferenceList[0]]++
+	}
+
+	// then place the missing replicas on the least loaded instances
+	for _, partition := range partitions {
+		preferenceList := result[partition]
+
+		for len(preferenceList) < replicas {
+			top := len(preferenceList) == 0
+			candidate := ""
+			for _, instance := range instances {
+				if load[instance] >= capacity || strSliceContains(preferenceList, instance) {
+					continue
+				}
+
+				if candidate == "" ||
+					(top && topLoad[instance] < topLoad[candidate]) ||
+					((!top || topLoad[instance] == topLoad[candidate]) && load[instance] < load[candidate]) {
+					candidate = instance
+				}
+			}
+
+			if candidate == "" {
+				// every instance is full
+				break
+			}
+
+			if top {
+				topLoad[candidate]++
+			}
+			preferenceList = append(preferenceList, candidate)
+			load[candidate]++
+		}
+
+		result[partition] = preferenceList
+	}
+
+	return result
+}
+
+// computeIdealStateAssignment places the partitions of the resource and their replicas on
+// the instances from scratch, as if none of them held any partition yet, and writes the
+// preference lists into the listFields and the states into the mapFields of the ideal state.
+func computeIdealStateAssignment(idealState *Record, def *StateModelDefinition, instances []string) {
+	resource := idealState.ID
+
+	cache := newClusterDataCache()
+	for _, instance := range instances {
+		cache.liveInstances[instance] = NewLiveInstanceNode(instance, "")
+	}
+
+	idealState.ListFields = map[string]interface{}{}
+	idealState.MapFields = map[string]map[string]string{}
+
+	for partition, preferenceList := range computeFullAutoPreferenceLists(resource, idealState, def, cache) {
+		idealState.SetListField(partition, preferenceList)
+
+		states := computeStatesFromPreferenceList(resource, partition, preferenceList, len(preferenceList), def, cache)
+		for instance, state := range states {
+			idealState.SetMapField(partition, instance, state)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package gohelix
+
+import (
+	"strconv"
+	"time"
+)
+
+// startHealthReports publishes the health reports of the participant right away, then
+// every health report interval until the participant is stopped.
+func (p *Participant) startHealthReports() {
+	p.Lock()
+	providers := len(p.healthReportProviders)
+	p.Unlock()
+	if providers == 0 {
+		return
+	}
+
+	interval := p.healthReportInterval
+	if interval <= 0 {
+		interval = defaultHealthReportInterval
+	}
+
+	stop := p.stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			p.publishHealthReports()
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// publishHealthReports writes the report of each provider to
+// /{cluster}/INSTANCES/{instance}/HEALTHREPORT/{name}.
+func (p *Participant) publishHealthReports() {
+	nowMilli := time.Now().UnixNano() / 1000000
+
+	// the providers may be added while the reports are published
+	p.Lock()
+	providers := make(map[string]HealthReportProvider, len(p.healthReportProviders))
+	for name, provider := range p.healthReportProviders {
+		providers[name] = provider
+	}
+	p.Unlock()
+
+	for name, provider := range providers {
+		report := newHealthReport(name, provider(), nowMilli)
+		if err := p.conn.OverwriteRecordForPath(p.kb.healthReportForName(p.ParticipantID, name), report); err != nil {
+			Logger.Printf("Failed to publish health report %s of %s: %s\n", name, p.ParticipantID, err.Error())
+		}
+	}
+}
+
+// newHealthReport creates the record of a health report, with the values reported in the
+// simpleFields along with the TIMESTAMP of the report in milliseconds.
+func newHealthReport(name string, values map[string]string, nowMilli int64) *Record {
+	report := NewRecord(name)
+	for key, value := range values {
+		report.SetSimpleField(key, value)
+	}
+	report.SetSimpleField("TIMESTAMP", strconv.FormatInt(nowMilli, 10))
+
+	return report
+}
@@ -0,0 +1,59 @@
+package gohelix
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewHealthReport(t *testing.T) {
+	t.Parallel()
+
+	report := newHealthReport("disk", map[string]string{"usage": "0.75", "free": "120G"}, 1425268051457)
+
+	if report.ID != "disk" {
+		t.Errorf("expect the report named disk, got %s", report.ID)
+	}
+	if report.GetStringField("usage", "") != "0.75" || report.GetStringField("free", "") != "120G" {
+		t.Errorf("wrong report values %v", report.SimpleFields)
+	}
+	if report.GetStringField("TIMESTAMP", "") != "1425268051457" {
+		t.Errorf("wrong report timestamp %s", report.GetStringField("TIMESTAMP", ""))
+	}
+}
+
+func TestAddHealthReportProviderConnected(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "healthreport_test_TestAddHealthReportProviderConnected_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+	a.SetConfig(cluster, "CLUSTER", map[string]string{"allowParticipantAutoJoin": "true"})
+
+	manager := NewHelixManager(testZkSvr)
+	p := manager.NewParticipant(cluster, "localhost", "12913")
+	p.RegisterStateModel("dummy", NewStateModel(nil))
+	p.SetHealthReportInterval(10 * time.Millisecond)
+	p.AddHealthReportProvider("disk", func() map[string]string {
+		return map[string]string{"usage": "0.75"}
+	})
+
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+
+	// a provider added while the reports are published is published too
+	p.AddHealthReportProvider("memory", func() map[string]string {
+		return map[string]string{"usage": "0.5"}
+	})
+
+	if !waitUntil(5*time.Second, func() bool {
+		report, err := p.conn.GetRecordFromPath(p.kb.healthReportForName(p.ParticipantID, "memory"))
+		return err == nil && report.GetStringField("usage", "") == "0.5"
+	}) {
+		t.Error("expect the memory report published")
+	}
+}
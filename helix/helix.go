@@ -282,6 +282,44 @@ func main() {
 				}
 			},
 		},
+		{
+			Name:  "stateModel",
+			Usage: "manage the state model definitions of a cluster",
+			Subcommands: []cli.Command{
+				{
+					Name:  "show",
+					Usage: "helix -z <zk> stateModel show <cluster> <stateModel> --format dot|mermaid",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "format, f",
+							Usage: "dot or mermaid",
+							Value: gohelix.DiagramFormatDOT,
+						},
+					},
+					Action: func(c *cli.Context) {
+						if err := mustArgc(c, 2); err != nil {
+							fmt.Println(err.Error())
+							return
+						}
+
+						admin := gohelix.Admin{c.GlobalString("zkSvr")}
+						cluster := c.Args().First()
+						def, err := admin.GetStateModelDef(cluster, c.Args().Get(1))
+						if err != nil {
+							fmt.Println(err.Error())
+							return
+						}
+
+						diagram, err := def.Diagram(c.String("format"))
+						if err != nil {
+							fmt.Println(err.Error())
+							return
+						}
+						fmt.Print(diagram)
+					},
+				},
+			},
+		},
 		{
 			Name:  "participant",
 			Usage: "helix -z <zk> participant -c <cluster> -s <host> -p <port> -t <stateMode>",
@@ -13,7 +13,9 @@ import (
 // /{cluster}/CONFIGS/RESOURCE
 // /{cluster}/CONTROLLER
 // /{cluster}/CONTROLLER/ERRORS
+// /{cluster}/CONTROLLER/EXTERNALVIEW_LEADER
 // /{cluster}/CONTROLLER/HISTORY
+// /{cluster}/CONTROLLER/LEADER
 // /{cluster}/CONTROLLER/MESSAGES
 // /{cluster}/CONTROLLER/STATUSUPDATES
 // /{cluster}/EXTERNALVIEW
@@ -68,10 +70,18 @@ func (k *keyBuilder) controllerErrors() string {
 	return fmt.Sprintf("/%s/CONTROLLER/ERRORS", k.clusterID)
 }
 
+func (k *keyBuilder) externalViewLeader() string {
+	return fmt.Sprintf("/%s/CONTROLLER/EXTERNALVIEW_LEADER", k.clusterID)
+}
+
 func (k *keyBuilder) controllerHistory() string {
 	return fmt.Sprintf("/%s/CONTROLLER/HISTORY", k.clusterID)
 }
 
+func (k *keyBuilder) controllerLeader() string {
+	return fmt.Sprintf("/%s/CONTROLLER/LEADER", k.clusterID)
+}
+
 func (k *keyBuilder) controllerMessages() string {
 	return fmt.Sprintf("/%s/CONTROLLER/MESSAGES", k.clusterID)
 }
@@ -148,10 +158,18 @@ func (k *keyBuilder) healthReport(participantID string) string {
 	return fmt.Sprintf("/%s/INSTANCES/%s/HEALTHREPORT", k.clusterID, participantID)
 }
 
+func (k *keyBuilder) healthReportForName(participantID string, name string) string {
+	return fmt.Sprintf("/%s/INSTANCES/%s/HEALTHREPORT/%s", k.clusterID, participantID, name)
+}
+
 func (k *keyBuilder) statusUpdates(participantID string) string {
 	return fmt.Sprintf("/%s/INSTANCES/%s/STATUSUPDATES", k.clusterID, participantID)
 }
 
+func (k *keyBuilder) statusUpdate(participantID string, sessionID string, resourceID string, partition string) string {
+	return fmt.Sprintf("/%s/INSTANCES/%s/STATUSUPDATES/%s/%s/%s", k.clusterID, participantID, sessionID, resourceID, partition)
+}
+
 func (k *keyBuilder) stateModels() string {
 	return fmt.Sprintf("/%s/STATEMODELDEFS", k.clusterID)
 }
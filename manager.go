@@ -42,6 +42,8 @@ func (m *HelixManager) NewSpectator(clusterID string) *Spectator {
 
 		// channel for receiving instance messages
 		instanceMessageChannel: make(chan string, 100),
+
+		retryPolicy: DefaultRetryPolicy,
 	}
 }
 
@@ -55,8 +57,50 @@ func (m *HelixManager) NewParticipant(clusterID string, host string, port string
 		ParticipantID: fmt.Sprintf("%s_%s", host, port), // node id
 		zkSvr:         m.zkSvr,
 		started:       make(chan interface{}),
-		stop:          make(chan bool),
-		stopWatch:     make(chan bool),
 		kb:            keyBuilder{clusterID: clusterID},
+
+		maxConcurrentTransitions: defaultMaxConcurrentTransitions,
+		resourceConcurrency:      map[string]int{},
+		transitions:              map[string]*pendingTransition{},
+		stateModelFactories:      map[string]map[string]StateModelFactory{},
+		partitionStateModels:     map[string]*StateModel{},
+		stateModelDefs:           map[string]*StateModelDefinition{},
+		messageHandlers:          map[string]MessageHandler{},
+		replies:                  map[string]chan *Record{},
+		statusUpdateRetention:    defaultStatusUpdateRetention,
+		healthReportProviders:    map[string]HealthReportProvider{},
+		healthReportInterval:     defaultHealthReportInterval,
+		retryPolicy:              DefaultRetryPolicy,
+	}
+}
+
+// NewController creates a new Helix Controller. Once connected, the controller joins the
+// leader election of the cluster, and drives the cluster toward its ideal state while it
+// is the leader.
+func (m *HelixManager) NewController(clusterID string) *Controller {
+	kb := keyBuilder{clusterID: clusterID}
+	return &Controller{
+		ClusterID:    clusterID,
+		ControllerID: defaultControllerID(),
+		zkSvr:        m.zkSvr,
+		leaderPath:   kb.controllerLeader(),
+		pipeline:     defaultPipeline,
+		kb:           kb,
+	}
+}
+
+// NewExternalViewAggregator creates a controller that only maintains the external view
+// of the cluster from the current states of the live instances. Use it when another
+// controller drives the state transitions. Aggregators elect a leader among themselves
+// through /{cluster}/CONTROLLER/EXTERNALVIEW_LEADER, so several can run for availability.
+func (m *HelixManager) NewExternalViewAggregator(clusterID string) *Controller {
+	kb := keyBuilder{clusterID: clusterID}
+	return &Controller{
+		ClusterID:    clusterID,
+		ControllerID: defaultControllerID(),
+		zkSvr:        m.zkSvr,
+		leaderPath:   kb.externalViewLeader(),
+		pipeline:     []pipelineStage{readClusterDataStage, externalViewStage},
+		kb:           kb,
 	}
 }
@@ -0,0 +1,332 @@
+package gohelix
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/yichen/go-zookeeper/zk"
+)
+
+// Criteria selects the live instances a user defined message is sent to. Each field is a
+// pattern as in path.Match, e.g. "localhost_*", and an empty field matches anything. When
+// Resource, Partition or PartitionState is set, the message goes to every instance holding
+// a matching partition in a matching state, once per partition, e.g. to the MASTER of
+// myDB_3 with {Resource: "myDB", Partition: "myDB_3", PartitionState: "MASTER"}.
+type Criteria struct {
+	InstanceName   string
+	Resource       string
+	Partition      string
+	PartitionState string
+}
+
+// MessageHandler handles a user defined message received by the participant. The result,
+// or the error, is sent back to the sender in the TASK_REPLY message.
+type MessageHandler func(message *Record) (map[string]string, error)
+
+// messageTarget is an instance a user defined message is sent to, and the partition it
+// is about, if any
+type messageTarget struct {
+	instance  string
+	resource  string
+	partition string
+}
+
+func (c Criteria) byPartition() bool {
+	return c.Resource != "" || c.Partition != "" || c.PartitionState != ""
+}
+
+// patternMatch tells if the value matches the pattern, an empty pattern matching anything
+func patternMatch(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// selectMessageTargets returns the targets of the criteria among the live instances and
+// their current states, sorted.
+func selectMessageTargets(criteria Criteria, cache *clusterDataCache) []messageTarget {
+	targets := []messageTarget{}
+
+	for instance := range cache.liveInstances {
+		if !patternMatch(criteria.InstanceName, instance) {
+			continue
+		}
+
+		if !criteria.byPartition() {
+			targets = append(targets, messageTarget{instance: instance})
+			continue
+		}
+
+		for resource, currentState := range cache.currentStates[instance] {
+			if !patternMatch(criteria.Resource, resource) {
+				continue
+			}
+
+			for partition, fields := range currentState.MapFields {
+				state := fields["CURRENT_STATE"]
+				if state == "" || state == "DROPPED" {
+					continue
+				}
+
+				if patternMatch(criteria.Partition, partition) && patternMatch(criteria.PartitionState, state) {
+					targets = append(targets, messageTarget{instance, resource, partition})
+				}
+			}
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		a, b := targets[i], targets[j]
+		if a.instance != b.instance {
+			return a.instance < b.instance
+		}
+		if a.resource != b.resource {
+			return a.resource < b.resource
+		}
+		return a.partition < b.partition
+	})
+
+	return targets
+}
+
+// RegisterMessageHandler registers the handler of the user defined messages of the type,
+// the MSG_SUBTYPE of the message. A message of a type without a handler is rejected.
+func (p *Participant) RegisterMessageHandler(msgType string, handler MessageHandler) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.messageHandlers == nil {
+		p.messageHandlers = make(map[string]MessageHandler)
+	}
+	p.messageHandlers[msgType] = handler
+}
+
+// SendMessage sends a USER_DEFINE_MSG message of the type, with the payload in its
+// MESSAGE_PAYLOAD map field, to each target of the criteria. With a positive timeout, it
+// waits for the TASK_REPLY messages of the targets, and returns those received in time,
+// with ErrReplyTimeout if some are missing. The result of a target is in the
+// MESSAGE_RESULT map field of its reply, along with the ERROR simple field if it failed.
+// The participant must be connected to receive the replies.
+func (p *Participant) SendMessage(criteria Criteria, msgType string, payload map[string]string, timeout time.Duration) ([]*Record, error) {
+	if p.getState() != psStarted {
+		return nil, ErrParticipantNotConnected
+	}
+
+	cache, err := p.readMessageTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	targets := selectMessageTargets(criteria, cache)
+	if len(targets) == 0 {
+		return []*Record{}, nil
+	}
+
+	// only the messages waiting for replies carry a CORRELATION_ID, so that the targets
+	// reply to them alone
+	var correlationID string
+	var replies chan *Record
+	if timeout > 0 {
+		correlationID = newUUID()
+		replies = make(chan *Record, len(targets))
+
+		p.Lock()
+		p.replies[correlationID] = replies
+		p.Unlock()
+
+		defer func() {
+			p.Lock()
+			delete(p.replies, correlationID)
+			p.Unlock()
+		}()
+	}
+
+	sent := 0
+	for _, target := range targets {
+		live := cache.liveInstances[target.instance]
+		message := p.newUserDefinedMessage(target, live.GetStringField("SESSION_ID", ""), msgType, payload, correlationID)
+
+		err := p.retryPolicy.do(func() error {
+			return p.conn.CreateRecordWithPath(p.kb.message(target.instance, message.ID), message)
+		})
+		if err != nil {
+			p.reportError(err)
+			continue
+		}
+		sent++
+	}
+
+	result := []*Record{}
+	if replies == nil {
+		return result, nil
+	}
+
+	deadline := time.After(timeout)
+	for len(result) < sent {
+		select {
+		case reply := <-replies:
+			result = append(result, reply)
+		case <-deadline:
+			return result, ErrReplyTimeout
+		}
+	}
+
+	if sent < len(targets) {
+		return result, ErrMessageNotSent
+	}
+	return result, nil
+}
+
+// readMessageTargets reads the live instances and their current states
+func (p *Participant) readMessageTargets() (*clusterDataCache, error) {
+	cache := newClusterDataCache()
+
+	instances, err := p.conn.Children(p.kb.liveInstances())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instance := range instances {
+		live, err := p.conn.GetRecordFromPath(p.kb.liveInstance(instance))
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		cache.liveInstances[instance] = live
+		cache.currentStates[instance] = map[string]*Record{}
+
+		sessionID := live.GetStringField("SESSION_ID", "")
+		resources, err := p.conn.Children(p.kb.currentStatesForSession(instance, sessionID))
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, resource := range resources {
+			record, err := p.conn.GetRecordFromPath(p.kb.currentStateForResource(instance, sessionID, resource))
+			if err == zk.ErrNoNode {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			cache.currentStates[instance][resource] = record
+		}
+	}
+
+	return cache, nil
+}
+
+func (p *Participant) newUserDefinedMessage(target messageTarget, sessionID string, msgType string, payload map[string]string, correlationID string) *Record {
+	msgID := newUUID()
+	nowMilli := time.Now().UnixNano() / 1000000
+
+	msg := NewRecord(msgID)
+	msg.SetSimpleField("MSG_ID", msgID)
+	msg.SetSimpleField("MSG_TYPE", "USER_DEFINE_MSG")
+	msg.SetSimpleField("MSG_SUBTYPE", msgType)
+	msg.SetSimpleField("MSG_STATE", "new")
+	msg.SetSimpleField("CREATE_TIMESTAMP", strconv.FormatInt(nowMilli, 10))
+	msg.SetSimpleField("SRC_NAME", p.ParticipantID)
+	msg.SetSimpleField("SRC_SESSION_ID", p.conn.GetSessionID())
+	msg.SetSimpleField("TGT_NAME", target.instance)
+	msg.SetSimpleField("TGT_SESSION_ID", sessionID)
+	if correlationID != "" {
+		msg.SetSimpleField("CORRELATION_ID", correlationID)
+	}
+	if target.resource != "" {
+		msg.SetSimpleField("RESOURCE_NAME", target.resource)
+		msg.SetSimpleField("PARTITION_NAME", target.partition)
+	}
+	for k, v := range payload {
+		msg.SetMapField("MESSAGE_PAYLOAD", k, v)
+	}
+
+	return msg
+}
+
+// newReplyMessage creates the TASK_REPLY message sent back to the sender of the message
+func newReplyMessage(message *Record, srcName string, srcSessionID string, result map[string]string, err error) *Record {
+	msgID := newUUID()
+	nowMilli := time.Now().UnixNano() / 1000000
+
+	reply := NewRecord(msgID)
+	reply.SetSimpleField("MSG_ID", msgID)
+	reply.SetSimpleField("MSG_TYPE", "TASK_REPLY")
+	reply.SetSimpleField("MSG_STATE", "new")
+	reply.SetSimpleField("CREATE_TIMESTAMP", strconv.FormatInt(nowMilli, 10))
+	reply.SetSimpleField("SRC_NAME", srcName)
+	reply.SetSimpleField("SRC_SESSION_ID", srcSessionID)
+	reply.SetSimpleField("TGT_NAME", message.GetStringField("SRC_NAME", ""))
+	reply.SetSimpleField("TGT_SESSION_ID", message.GetStringField("SRC_SESSION_ID", ""))
+	reply.SetSimpleField("CORRELATION_ID", message.GetStringField("CORRELATION_ID", ""))
+	reply.SetSimpleField("MSG_SUBTYPE", message.GetStringField("MSG_SUBTYPE", ""))
+	if resource := message.GetStringField("RESOURCE_NAME", ""); resource != "" {
+		reply.SetSimpleField("RESOURCE_NAME", resource)
+		reply.SetSimpleField("PARTITION_NAME", message.GetStringField("PARTITION_NAME", ""))
+	}
+
+	reply.MapFields["MESSAGE_RESULT"] = map[string]string{}
+	for k, v := range result {
+		reply.SetMapField("MESSAGE_RESULT", k, v)
+	}
+	if err != nil {
+		reply.SetSimpleField("ERROR", err.Error())
+	}
+
+	return reply
+}
+
+// handleUserMessage runs the handler of the user defined message, and replies to the sender
+// when it waits for the result. The message is removed even without a handler for its type,
+// since the sender is told with the ERROR of the reply.
+func (p *Participant) handleUserMessage(message *Record) error {
+	msgType := message.GetStringField("MSG_SUBTYPE", "")
+
+	p.Lock()
+	handler, ok := p.messageHandlers[msgType]
+	p.Unlock()
+
+	var result map[string]string
+	err := ErrMessageHandlerNotRegistered
+	if ok {
+		result, err = handler(message)
+	}
+
+	if message.GetStringField("CORRELATION_ID", "") != "" {
+		reply := newReplyMessage(message, p.ParticipantID, p.conn.GetSessionID(), result, err)
+		path := p.kb.message(message.GetStringField("SRC_NAME", ""), reply.ID)
+		if e := p.retryPolicy.do(func() error { return p.conn.CreateRecordWithPath(path, reply) }); e != nil {
+			p.reportError(e)
+		}
+	}
+
+	if !ok {
+		Logger.Printf("Participant %s drops message %s: %s %s\n", p.ParticipantID, message.ID, err.Error(), msgType)
+	}
+	return nil
+}
+
+// handleReply hands the TASK_REPLY message to the SendMessage waiting for it. Replies coming
+// after the timeout are dropped.
+func (p *Participant) handleReply(message *Record) error {
+	p.Lock()
+	replies, ok := p.replies[message.GetStringField("CORRELATION_ID", "")]
+	p.Unlock()
+
+	if ok {
+		select {
+		case replies <- message:
+		default:
+		}
+	}
+	return nil
+}
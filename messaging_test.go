@@ -0,0 +1,125 @@
+package gohelix
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSelectMessageTargets(t *testing.T) {
+	t.Parallel()
+
+	cache := newClusterDataCache()
+	for _, instance := range []string{"localhost_1", "localhost_2", "remote_1"} {
+		cache.liveInstances[instance] = NewLiveInstanceNode(instance, "session")
+		cache.currentStates[instance] = map[string]*Record{}
+	}
+
+	db := NewRecord("db")
+	db.SetMapField("db_0", "CURRENT_STATE", "MASTER")
+	db.SetMapField("db_1", "CURRENT_STATE", "SLAVE")
+	cache.currentStates["localhost_1"]["db"] = db
+
+	db = NewRecord("db")
+	db.SetMapField("db_0", "CURRENT_STATE", "SLAVE")
+	db.SetMapField("db_1", "CURRENT_STATE", "MASTER")
+	cache.currentStates["localhost_2"]["db"] = db
+
+	targets := selectMessageTargets(Criteria{InstanceName: "localhost_*"}, cache)
+	if len(targets) != 2 || targets[0].instance != "localhost_1" || targets[1].instance != "localhost_2" || targets[0].partition != "" {
+		t.Errorf("expect the localhost instances, got %v", targets)
+	}
+
+	targets = selectMessageTargets(Criteria{Resource: "db", Partition: "db_1", PartitionState: "MASTER"}, cache)
+	if len(targets) != 1 || targets[0] != (messageTarget{"localhost_2", "db", "db_1"}) {
+		t.Errorf("expect the master of db_1, got %v", targets)
+	}
+
+	targets = selectMessageTargets(Criteria{Resource: "db", PartitionState: "SLAVE"}, cache)
+	if len(targets) != 2 || targets[0] != (messageTarget{"localhost_1", "db", "db_1"}) || targets[1] != (messageTarget{"localhost_2", "db", "db_0"}) {
+		t.Errorf("expect the slaves of db, got %v", targets)
+	}
+
+	if targets = selectMessageTargets(Criteria{Resource: "other"}, cache); len(targets) != 0 {
+		t.Errorf("expect no target, got %v", targets)
+	}
+}
+
+func TestNewReplyMessage(t *testing.T) {
+	t.Parallel()
+
+	message := NewRecord("msg")
+	message.SetSimpleField("SRC_NAME", "localhost_1")
+	message.SetSimpleField("SRC_SESSION_ID", "session_1")
+	message.SetSimpleField("CORRELATION_ID", "correlation")
+	message.SetSimpleField("MSG_SUBTYPE", "flush")
+	message.SetSimpleField("RESOURCE_NAME", "db")
+	message.SetSimpleField("PARTITION_NAME", "db_3")
+
+	reply := newReplyMessage(message, "localhost_2", "session_2", map[string]string{"flushed": "10"}, nil)
+	if reply.GetStringField("MSG_TYPE", "") != "TASK_REPLY" ||
+		reply.GetStringField("TGT_NAME", "") != "localhost_1" ||
+		reply.GetStringField("TGT_SESSION_ID", "") != "session_1" ||
+		reply.GetStringField("SRC_NAME", "") != "localhost_2" ||
+		reply.GetStringField("CORRELATION_ID", "") != "correlation" ||
+		reply.GetStringField("PARTITION_NAME", "") != "db_3" {
+		t.Errorf("wrong reply %s", reply)
+	}
+	if reply.GetMapField("MESSAGE_RESULT", "flushed") != "10" || reply.GetSimpleField("ERROR") != nil {
+		t.Errorf("wrong reply result %s", reply)
+	}
+
+	reply = newReplyMessage(message, "localhost_2", "session_2", nil, errors.New("disk full"))
+	if reply.GetStringField("ERROR", "") != "disk full" {
+		t.Errorf("expect the error in the reply, got %s", reply)
+	}
+}
+
+func TestSendMessageWithoutHandler(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "messaging_test_TestSendMessageWithoutHandler_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+	a.SetConfig(cluster, "CLUSTER", map[string]string{"allowParticipantAutoJoin": "true"})
+
+	manager := NewHelixManager(testZkSvr)
+	p := manager.NewParticipant(cluster, "localhost", "12913")
+	p.RegisterStateModel(StateModelOnlineOffline, NewStateModel([]Transition{
+		{"OFFLINE", "ONLINE", nil},
+		{"ONLINE", "OFFLINE", nil},
+		{"OFFLINE", "DROPPED", nil},
+	}))
+
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+
+	// a message sent without waiting carries no CORRELATION_ID, so it gets no reply
+	message := p.newUserDefinedMessage(messageTarget{instance: p.ParticipantID}, p.conn.GetSessionID(), "flush", nil, "")
+	if message.GetSimpleField("CORRELATION_ID") != nil {
+		t.Errorf("expect no CORRELATION_ID, got %s", message)
+	}
+
+	// the participant has no handler of its own message, and tells itself so
+	replies, err := p.SendMessage(Criteria{InstanceName: p.ParticipantID}, "flush", nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 1 || replies[0].GetStringField("ERROR", "") != ErrMessageHandlerNotRegistered.Error() {
+		t.Fatalf("expect a reply with the error, got %v", replies)
+	}
+
+	// the message is removed all the same, rather than left unprocessable
+	path := p.kb.messages(p.ParticipantID)
+	if !waitUntil(5*time.Second, func() bool {
+		messages, err := p.conn.Children(path)
+		return err == nil && len(messages) == 0
+	}) {
+		t.Error("expect the messages removed once handled")
+	}
+}
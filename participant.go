@@ -1,9 +1,11 @@
 package gohelix
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,6 +23,30 @@ const (
 	psDisconnected participantState = 3
 )
 
+const (
+	// defaultMaxConcurrentTransitions is the number of state transitions a participant
+	// runs at the same time unless set otherwise
+	defaultMaxConcurrentTransitions = 40
+
+	// defaultStatusUpdateRetention is the number of status updates kept for each
+	// partition unless set otherwise
+	defaultStatusUpdateRetention = 20
+
+	// defaultHealthReportInterval is how often the health reports are published unless
+	// set otherwise
+	defaultHealthReportInterval = time.Minute
+
+	// shutdownCancelWait is how long Shutdown waits for the transitions it cancelled to
+	// return before it disconnects anyway
+	shutdownCancelWait = 5 * time.Second
+)
+
+// pendingTransition is a state transition message submitted but not processed yet
+type pendingTransition struct {
+	message *Record
+	cancel  context.CancelFunc
+}
+
 // Participant is a Helix participant node
 type Participant struct {
 	// HelixManager
@@ -44,14 +70,23 @@ type Participant struct {
 	// an instance of StateModel
 	stateModels map[string]*StateModel
 
+	// state model name -> factory name -> factory of per partition state models
+	stateModelFactories map[string]map[string]StateModelFactory
+
+	// resource/partition -> state model created by a factory
+	partitionStateModels map[string]*StateModel
+
+	// the definitions of the state models of the messages, read again once they change
+	stateModelDefs map[string]*StateModelDefinition
+
 	// channel to receive upon start of event loop
 	started chan interface{}
-	// channel to receive stop participant event
-	stop chan bool
-	// channel to stop watch messages
-	stopWatch chan bool
+	// closed to stop the event loop, its message watch and the health reports, then
+	// stopped is closed once the event loop returns
+	stop    chan bool
+	stopped chan struct{}
 
-	// status
+	// status, guarded by the mutex
 	state participantState
 
 	// keybuilder
@@ -60,6 +95,42 @@ type Participant struct {
 	// pre-connect callbacks
 	preConnectCallbacks []func()
 
+	// the number of transitions running at the same time, overall and per resource
+	maxConcurrentTransitions int
+	resourceConcurrency      map[string]int
+
+	// runs the transitions of the messages
+	executor *messageExecutor
+
+	// transitions pending or running, by message ID, to cancel them
+	transitions map[string]*pendingTransition
+
+	// the number of status updates kept for each partition
+	statusUpdateRetention int
+
+	// health report providers by name, and how often they are published
+	healthReportProviders map[string]HealthReportProvider
+	healthReportInterval  time.Duration
+
+	// session change callbacks
+	sessionChangeCallbacks []func(sessionID string, err error)
+
+	// handlers of the user defined messages by MSG_SUBTYPE, and the messages sent waiting
+	// for their replies by CORRELATION_ID
+	messageHandlers map[string]MessageHandler
+	replies         map[string]chan *Record
+
+	// interceptors around every transition, the first one outermost
+	interceptors []TransitionInterceptor
+
+	// whether Shutdown brings the partitions of the participant to the initial state
+	offlineOnShutdown bool
+
+	// how the zookeeper operations of the participant are retried, and who is told when
+	// they fail for good
+	retryPolicy    RetryPolicy
+	errorCallbacks []func(err error)
+
 	sync.Mutex
 }
 
@@ -72,7 +143,7 @@ type Participant struct {
 func (p *Participant) Connect() error {
 
 	// validate the data structure before connecting to Zookeeper servers
-	if len(p.stateModels) == 0 {
+	if len(p.stateModels) == 0 && len(p.stateModelFactories) == 0 {
 		return errors.New("Register at least one valid state model before connecting.")
 	}
 
@@ -81,75 +152,255 @@ func (p *Participant) Connect() error {
 		cb()
 	}
 
-	if !p.conn.IsConnected() {
+	if p.conn == nil || !p.conn.IsConnected() {
 		p.conn = newConnection(p.zkSvr)
-		p.conn.Connect()
+		p.conn.retryPolicy = p.retryPolicy
+		if err := p.conn.Connect(); err != nil {
+			return err
+		}
 	}
 
+	// from now on, a failure disconnects
+	p.setState(psConnected)
+
 	if ok, err := p.conn.IsClusterSetup(p.ClusterID); !ok || err != nil {
+		p.Disconnect()
 		return ErrClusterNotSetup
 	}
 
+	// fail now rather than leave partitions stuck on a transition without a handler
+	if err := p.validateStateModels(); err != nil {
+		p.Disconnect()
+		return err
+	}
+
 	// register the participant with the cluster
-	allowed := p.ensureParticipantConfig()
+	allowed, err := p.ensureParticipantConfig()
+	if err != nil {
+		p.Disconnect()
+		return err
+	}
 	if !allowed {
 		p.Disconnect()
 		return ErrEnsureParticipantConfig
 	}
 
 	// clean up current state of previous sessions
-	p.cleanUp()
+	if err := p.retryPolicy.do(p.cleanUp); err != nil {
+		p.Disconnect()
+		return err
+	}
 
 	p.startEventLoop()
 
 	// bring this participant alive.
-	p.createLiveInstance()
+	if err := p.createLiveInstance(); err != nil {
+		p.Disconnect()
+		return err
+	}
+
+	p.startHealthReports()
 
 	// block on p.started
 	// <-p.started
 	return nil
 }
 
-func (p *Participant) cleanUp() {
+func (p *Participant) cleanUp() error {
 	currentStatePath := p.kb.currentStates(p.ParticipantID)
 
 	sessions, err := p.conn.Children(currentStatePath)
-	must(err)
+	if err != nil {
+		return err
+	}
 
 	for _, sessionID := range sessions {
 		if sessionID != p.conn.GetSessionID() {
 			path := currentStatePath + "/" + sessionID
-			err = p.conn.DeleteTree(path)
-			must(err)
+			if err = p.conn.DeleteTree(path); err != nil {
+				return err
+			}
 		}
 	}
+
+	// the status updates of previous sessions go away with their current states
+	statusUpdatesPath := p.kb.statusUpdates(p.ParticipantID)
+	if exists, _ := p.conn.Exists(statusUpdatesPath); !exists {
+		return nil
+	}
+
+	sessions, err = p.conn.Children(statusUpdatesPath)
+	if err != nil {
+		return err
+	}
+
+	for _, sessionID := range sessions {
+		if sessionID != p.conn.GetSessionID() {
+			if err = p.conn.DeleteTree(statusUpdatesPath + "/" + sessionID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
-// Disconnect the participant from Zookeeper and Helix controller
+// Disconnect the participant from Zookeeper and Helix controller. The transitions pending or
+// running are cancelled, and given a few seconds to return before the connection closes.
 func (p *Participant) Disconnect() {
-	// do i need lock here?
-	if p.state == psDisconnected {
+	if p.getState() == psDisconnected {
 		return
 	}
 
-	// if the state is connected, it means we are not in event loop
-	// if the state is started, it means we are in event loop and need to sent
-	// the stop message
-	// if the status is started, it means the event loop is running
-	// wait for it to stop
-	if p.state == psStarted {
-		p.stop <- true
-		close(p.stop)
-		for p.state != psStopped {
-			time.Sleep(100 * time.Millisecond)
-		}
-	}
+	// if the state is started, the event loop is running: stop it and wait for it
+	p.stopEventLoop()
+
+	// the transitions write their current states through the connection
+	p.abortTransitions()
 
 	if p.conn.IsConnected() {
 		p.conn.Disconnect()
 	}
 
-	p.state = psDisconnected
+	p.setState(psDisconnected)
+}
+
+func (p *Participant) stopEventLoop() {
+	if p.getState() == psStarted {
+		close(p.stop)
+		<-p.stopped
+	}
+}
+
+// abortTransitions refuses the transitions submitted from now on, cancels the pending and
+// running ones, and gives the running ones a few seconds to return.
+func (p *Participant) abortTransitions() {
+	if p.executor == nil {
+		return
+	}
+
+	// the messages not started yet stay NEW, and are removed with the session
+	for _, task := range p.executor.stop() {
+		p.removeTransition(task.msgID)
+	}
+	p.cancelTransitions()
+
+	// the cancelled handlers may still use the connection until they return
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownCancelWait)
+	defer cancel()
+	if err := p.executor.wait(ctx); err != nil {
+		Logger.Printf("Participant %s disconnects with transitions still running\n", p.ParticipantID)
+	}
+}
+
+func (p *Participant) getState() participantState {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.state
+}
+
+func (p *Participant) setState(state participantState) {
+	p.Lock()
+	p.state = state
+	p.Unlock()
+}
+
+// Shutdown disconnects the participant gracefully, so that it can be restarted without
+// leaving partitions in ERROR. It stops taking new messages, waits for the running
+// transitions to finish, brings the partitions to the initial state of their state model,
+// e.g. OFFLINE, if SetOfflineOnShutdown is set, then removes its live instance and
+// disconnects. When the ctx is done first, the transitions still running are cancelled
+// and given a few seconds to return, and the ctx error is returned, but the participant
+// disconnects all the same.
+func (p *Participant) Shutdown(ctx context.Context) error {
+	if p.getState() != psStarted {
+		p.Disconnect()
+		return nil
+	}
+
+	p.stopEventLoop()
+
+	// the messages not started yet stay NEW, and are removed with the session
+	for _, task := range p.executor.stop() {
+		p.removeTransition(task.msgID)
+	}
+
+	err := p.executor.wait(ctx)
+	if err != nil {
+		Logger.Printf("Participant %s cancels the transitions still running: %s\n", p.ParticipantID, err.Error())
+		p.abortTransitions()
+	} else if p.offlineOnShutdown {
+		err = p.goOffline(ctx)
+	}
+
+	if e := p.conn.Delete(p.kb.liveInstance(p.ParticipantID)); e != nil && e != zk.ErrNoNode {
+		Logger.Printf("Participant %s failed to remove its live instance: %s\n", p.ParticipantID, e.Error())
+	}
+
+	p.Disconnect()
+	return err
+}
+
+// goOffline brings the partitions in the current states of the session to the initial state
+// of their state model, one transition at a time, with the handlers registered for them.
+// Partitions in ERROR are left alone.
+func (p *Participant) goOffline(ctx context.Context) error {
+	sessionID := p.conn.GetSessionID()
+	liveInstance := NewLiveInstanceNode(p.ParticipantID, sessionID)
+
+	resources, err := p.conn.Children(p.kb.currentStatesForSession(p.ParticipantID, sessionID))
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, resource := range resources {
+		currentState, err := p.conn.GetRecordFromPath(p.kb.currentStateForResource(p.ParticipantID, sessionID, resource))
+		if err != nil {
+			return err
+		}
+
+		stateModel := currentState.GetStringField("STATE_MODEL_DEF", "")
+		factoryName := currentState.GetStringField("STATE_MODEL_FACTORY_NAME", "DEFAULT")
+		def, err := p.stateModelDef(stateModel)
+		if err != nil {
+			return err
+		}
+
+		for partition, fields := range currentState.MapFields {
+			state := fields["CURRENT_STATE"]
+
+			for state != "" && state != def.InitialState && state != "ERROR" && state != "DROPPED" {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				next := def.NextState(state, def.InitialState)
+				if next == "" {
+					Logger.Printf("State model %s has no way from %s to %s for %s\n", stateModel, state, def.InitialState, partition)
+					break
+				}
+
+				message := newStateTransitionMessage(p.ParticipantID, sessionID, liveInstance, resource, partition, stateModel, factoryName,
+					stateTransition{instance: p.ParticipantID, fromState: state, toState: next})
+				handler, err := p.transitionHandler(message)
+				if err != nil {
+					break
+				}
+
+				state = p.runStateTransition(ctx, handler, message)
+				if state == "" {
+					return ErrTransitionCancelled
+				}
+				p.postHandleMessage(message, map[string]string{partition: state})
+			}
+		}
+	}
+
+	return nil
 }
 
 // RegisterStateModel associates state trasition functions with the participant
@@ -160,38 +411,272 @@ func (p *Participant) RegisterStateModel(name string, sm StateModel) {
 	p.stateModels[name] = &sm
 }
 
+// validateStateModels checks the registered state models against their definitions under
+// /{cluster}/STATEMODELDEFS. The state models the cluster does not define yet, and those
+// created by factories, are not checked.
+func (p *Participant) validateStateModels() error {
+	for name, sm := range p.stateModels {
+		def, err := p.stateModelDef(name)
+		if err == zk.ErrNoNode {
+			Logger.Printf("State model %s is not defined in cluster %s\n", name, p.ClusterID)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := def.validateStateModel(sm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkTransition makes sure the FROM_STATE and TO_STATE of the message are a single hop of
+// its state model definition. Messages of a state model the cluster does not define are
+// let through.
+func (p *Participant) checkTransition(message *Record) error {
+	name := message.GetStringField("STATE_MODEL_DEF", "")
+	fromState := message.GetStringField("FROM_STATE", "")
+	toState := message.GetStringField("TO_STATE", "")
+
+	def, err := p.stateModelDef(name)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !def.AllowsTransition(fromState, toState) {
+		Logger.Printf("State model %s does not allow the transition from %s to %s of %s\n", name, fromState, toState, message.ID)
+		return ErrIllegalTransition
+	}
+	return nil
+}
+
+// stateModelDef returns the definition of the state model, read from zookeeper the first
+// time, and again once it changes there.
+func (p *Participant) stateModelDef(name string) (*StateModelDefinition, error) {
+	p.Lock()
+	def, ok := p.stateModelDefs[name]
+	p.Unlock()
+	if ok {
+		return def, nil
+	}
+
+	data, events, err := p.conn.GetW(p.kb.stateModel(name))
+	if err != nil {
+		return nil, err
+	}
+	record, err := NewRecordFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	def, err = NewStateModelDefinitionFromRecord(record)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	if p.stateModelDefs == nil {
+		p.stateModelDefs = make(map[string]*StateModelDefinition)
+	}
+	p.stateModelDefs[name] = def
+	p.Unlock()
+
+	// the watch also fires when the connection closes, which drops the definition as well
+	go func() {
+		<-events
+
+		p.Lock()
+		if p.stateModelDefs[name] == def {
+			delete(p.stateModelDefs, name)
+		}
+		p.Unlock()
+	}()
+
+	return def, nil
+}
+
+// RegisterStateModelFactory registers the factory creating the state model of each partition
+// for the messages of the state model, e.g. MasterSlave, with the factory name in their
+// STATE_MODEL_FACTORY_NAME, "DEFAULT" unless set otherwise in the ideal state. A factory
+// takes precedence over the state model registered with RegisterStateModel.
+func (p *Participant) RegisterStateModelFactory(name string, factoryName string, factory StateModelFactory) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.stateModelFactories == nil {
+		p.stateModelFactories = make(map[string]map[string]StateModelFactory)
+	}
+	if p.stateModelFactories[name] == nil {
+		p.stateModelFactories[name] = make(map[string]StateModelFactory)
+	}
+	p.stateModelFactories[name][factoryName] = factory
+}
+
+// stateModel returns the state model for the partition of the message: the one created for
+// the partition by the factory of the message, or else the one registered for all partitions.
+func (p *Participant) stateModel(message *Record) (*StateModel, bool) {
+	name := message.GetStringField("STATE_MODEL_DEF", "")
+	factoryName := message.GetStringField("STATE_MODEL_FACTORY_NAME", "DEFAULT")
+
+	p.Lock()
+	defer p.Unlock()
+
+	factory, ok := p.stateModelFactories[name][factoryName]
+	if !ok {
+		sm, ok := p.stateModels[name]
+		return sm, ok
+	}
+
+	key := message.GetStringField("RESOURCE_NAME", "") + "/" + message.GetStringField("PARTITION_NAME", "")
+	if sm, ok := p.partitionStateModels[key]; ok {
+		return sm, true
+	}
+
+	sm := factory.CreateStateModel(message.GetStringField("RESOURCE_NAME", ""), message.GetStringField("PARTITION_NAME", ""))
+	if p.partitionStateModels == nil {
+		p.partitionStateModels = make(map[string]*StateModel)
+	}
+	p.partitionStateModels[key] = &sm
+	return &sm, true
+}
+
+// dropStateModel forgets the state model created for the partition once it is DROPPED.
+func (p *Participant) dropStateModel(resource string, partition string) {
+	p.Lock()
+	delete(p.partitionStateModels, resource+"/"+partition)
+	p.Unlock()
+}
+
+// AddSessionChangeCallback adds a callback invoked when the participant recovers from an
+// expired zookeeper session. It gets the new session ID, and the error if the participant
+// failed to register itself again with the new session.
+func (p *Participant) AddSessionChangeCallback(callback func(sessionID string, err error)) {
+	p.sessionChangeCallbacks = append(p.sessionChangeCallbacks, callback)
+}
+
+// AddHealthReportProvider adds a provider of the health report of the given name. Once the
+// participant is connected, the report is published every health report interval under
+// /{cluster}/INSTANCES/{instance}/HEALTHREPORT/{name}.
+func (p *Participant) AddHealthReportProvider(name string, provider HealthReportProvider) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.healthReportProviders == nil {
+		p.healthReportProviders = make(map[string]HealthReportProvider)
+	}
+	p.healthReportProviders[name] = provider
+}
+
+// SetHealthReportInterval sets how often the health reports are published, every minute by
+// default. It takes effect on the next Connect.
+func (p *Participant) SetHealthReportInterval(interval time.Duration) {
+	p.healthReportInterval = interval
+}
+
+// AddTransitionInterceptor adds an interceptor around every state transition of the
+// participant. Interceptors run in the order they are added, each one around the next.
+func (p *Participant) AddTransitionInterceptor(interceptor TransitionInterceptor) {
+	p.interceptors = append(p.interceptors, interceptor)
+}
+
+// AddErrorCallback adds a callback told about the zookeeper errors the participant cannot
+// recover from by retrying, such as a current state it fails to update. Without any, the
+// errors are logged.
+func (p *Participant) AddErrorCallback(callback func(err error)) {
+	p.errorCallbacks = append(p.errorCallbacks, callback)
+}
+
+// SetRetryPolicy sets how the participant retries the zookeeper operations that fail,
+// DefaultRetryPolicy by default. It takes effect on Connect.
+func (p *Participant) SetRetryPolicy(policy RetryPolicy) {
+	p.retryPolicy = policy
+}
+
+func (p *Participant) reportError(err error) {
+	Logger.Printf("Participant %s: %s\n", p.ParticipantID, err.Error())
+	for _, cb := range p.errorCallbacks {
+		cb(err)
+	}
+}
+
+// SetOfflineOnShutdown sets whether Shutdown brings the partitions of the participant to the
+// initial state of their state model, e.g. OFFLINE, before removing the live instance, so
+// that the controller moves their replicas elsewhere. It is off by default.
+func (p *Participant) SetOfflineOnShutdown(offline bool) {
+	p.offlineOnShutdown = offline
+}
+
+// SetStatusUpdateRetention sets the number of transitions kept in the status update history
+// of each partition, 20 by default. Zero turns the status updates off.
+func (p *Participant) SetStatusUpdateRetention(n int) {
+	p.statusUpdateRetention = n
+}
+
+// SetMaxConcurrentTransitions sets the number of state transitions the participant runs at
+// the same time, 40 by default. Transitions of the same partition always run one after the
+// other, in order. It takes effect on the next Connect.
+func (p *Participant) SetMaxConcurrentTransitions(n int) {
+	p.maxConcurrentTransitions = n
+}
+
+// SetResourceConcurrency limits the number of state transitions of the resource running at
+// the same time, e.g. to bootstrap one partition of a database at a time. It takes effect
+// on the next Connect.
+func (p *Participant) SetResourceConcurrency(resource string, n int) {
+	if p.resourceConcurrency == nil {
+		p.resourceConcurrency = make(map[string]int)
+	}
+	p.resourceConcurrency[resource] = n
+}
+
 // AddPreConnectCallback adds a pre-connect callback
 func (p *Participant) AddPreConnectCallback(callback func()) {
 	p.preConnectCallbacks = append(p.preConnectCallbacks, callback)
 }
 
-func (p *Participant) autoJoinAllowed() bool {
+func (p *Participant) autoJoinAllowed() (bool, error) {
 	key := p.kb.clusterConfig()
+
 	config, err := p.conn.Get(key)
-	must(err)
+	if err != nil {
+		return false, err
+	}
 
 	c, err := NewRecordFromBytes(config)
-	must(err)
+	if err != nil {
+		return false, err
+	}
 
 	allowed := c.GetSimpleField("allowParticipantAutoJoin")
 	if allowed == nil {
-		return false
+		return false, nil
 	}
 
 	al := allowed.(string)
 	if strings.ToLower(al) == "true" {
-		return true
+		return true, nil
 	}
-	return false
+	return false, nil
 }
 
-func (p *Participant) ensureParticipantConfig() bool {
+func (p *Participant) ensureParticipantConfig() (bool, error) {
 	// make sure the participant confis exists in zookeeper
 	key := p.kb.participantConfig(p.ParticipantID)
+
 	exists, err := p.conn.Exists(key)
-	must(err)
+	if err != nil {
+		return false, err
+	}
 
-	allowJoin := p.autoJoinAllowed()
+	allowJoin, err := p.autoJoinAllowed()
+	if err != nil {
+		return false, err
+	}
 
 	// if the participant path does not exist in zookeeper
 	// create the data struture
@@ -223,10 +708,10 @@ func (p *Participant) ensureParticipantConfig() bool {
 		updates := p.kb.statusUpdates(p.ParticipantID)
 		p.conn.CreateEmptyNode(updates)
 	} else if !exists {
-		return false
+		return false, nil
 	}
 
-	return true
+	return true, nil
 }
 
 // handleClusterMessage dispatches the cluster message to the corresponding
@@ -261,20 +746,29 @@ func (p *Participant) ensureParticipantConfig() bool {
 //   READ, // not used
 //   UNPROCESSABLE // get exception when create handler
 // }
-func (p *Participant) processMessage(msgID string) {
+func (p *Participant) processMessage(ctx context.Context, message *Record) {
+	if !p.acceptMessage(message) {
+		return
+	}
+
+	p.completeMessage(message, p.handleMessage(ctx, message))
+}
+
+// acceptMessage takes the message for this session, and creates the current state of its
+// resource if needed. It returns false if the message is not to be processed: it is a
+// NO-OP, for another session, or taken already.
+func (p *Participant) acceptMessage(message *Record) bool {
+	msgID := message.ID
 	fmt.Println("Process message: " + msgID)
 
 	msgPath := p.kb.message(p.ParticipantID, msgID)
-	message, err := p.conn.GetRecordFromPath(msgPath)
-	must(err)
-
 	msgType := message.GetSimpleField("MSG_TYPE").(string)
 
 	if msgType == "NO_OP" {
 		Logger.Printf("Dropping NO-OP message. mid: %s, from: %s\n", msgID, message.GetSimpleField("SRC_NAME"))
 		fmt.Println("Delete NO-OP message: " + msgID)
 		p.conn.DeleteTree(msgPath)
-		return
+		return false
 	}
 
 	sessionID := message.GetSimpleField("TGT_SESSION_ID").(string)
@@ -285,22 +779,22 @@ func (p *Participant) processMessage(msgID string) {
 
 		fmt.Println("delete expired message: " + msgID + ". expected sessionID:" + p.conn.GetSessionID() + ", tgtSessionID in message:" + sessionID)
 		p.conn.DeleteTree(msgPath)
-		return
+		return false
 	}
 
-	// don't process message that is of READ or UNPROCESSABLE state
-	msgState := message.GetSimpleField("MSG_STATE").(string)
-	// ignore the message if it is READ. The READ message is not deleted until the state has changed
-	if !strings.EqualFold(msgState, "NEW") {
+	// don't process message that is of READ or UNPROCESSABLE state. The message is marked
+	// READ in zookeeper before it is processed, so that it runs only once however many
+	// times it is read
+	claimed, err := p.claimMessage(msgPath, message)
+	if err != nil {
+		p.reportError(fmt.Errorf("failed to read message %s: %s", msgID, err.Error()))
+		return false
+	}
+	if !claimed {
 		fmt.Println("skip message: " + msgID)
-		return
+		return false
 	}
 
-	// update msgState to read
-	message.SetSimpleField("MSG_STATE", "READ")
-	message.SetSimpleField("READ_TIMESTAMP", time.Now().Unix())
-	message.SetSimpleField("EXE_SESSION_ID", p.conn.GetSessionID())
-
 	// create current state meta data
 	// do it for non-controller and state transition messages only
 	targetName := message.GetSimpleField("TGT_NAME").(string)
@@ -329,26 +823,243 @@ func (p *Participant) processMessage(msgID string) {
 		// save to zookeeper
 		path := p.kb.currentStateForResource(p.ParticipantID, sessionID, resourceID)
 
-		// let's only set the current state if it is empty
+		// let's only set the current state if it is empty. Transitions of other partitions
+		// of the resource may be creating it at the same time
 		if exists, _ := p.conn.Exists(path); !exists {
 			fmt.Println("Setting " + path + ":\n" + currentStateRecord.String())
-			err := p.conn.SetRecordForPath(path, currentStateRecord)
-			must(err)
+			err := p.retryPolicy.do(func() error {
+				return p.conn.CreateRecordWithPath(path, currentStateRecord)
+			})
+			if err != nil && err != zk.ErrNodeExists {
+				// the message stays READ, and the controller sends the transition again
+				// once the message is removed with the session
+				p.reportError(fmt.Errorf("failed to create the current state %s: %s", path, err.Error()))
+				return false
+			}
 		}
 	}
 
-	p.handleStateTransition(message)
+	return true
+}
+
+// completeMessage removes the message once processed, or marks it unprocessable if the
+// processing failed with the err.
+func (p *Participant) completeMessage(message *Record, err error) {
+	msgPath := p.kb.message(p.ParticipantID, message.ID)
+
+	if err != nil {
+		// the message stays, marked as unprocessable, until the controller removes it
+		// and retries the transition
+		Logger.Printf("Rejecting message %s: %s\n", message.ID, err.Error())
+		message.SetSimpleField("MSG_STATE", "unprocessable")
+		p.conn.OverwriteRecordForPath(msgPath, message)
+		return
+	}
 
 	// after the message is processed successfully, remove it
 	p.conn.DeleteTree(msgPath)
 }
 
-func (p *Participant) handleStateTransition(message *Record) {
-	// verify the fromState with the current state model
-	fromState := message.GetSimpleField("FROM_STATE").(string)
-	toState := message.GetSimpleField("TO_STATE").(string)
+// handleMessage dispatches the message by its MSG_TYPE
+func (p *Participant) handleMessage(ctx context.Context, message *Record) error {
+	switch message.GetStringField("MSG_TYPE", "") {
+	case "USER_DEFINE_MSG":
+		return p.handleUserMessage(message)
+	case "TASK_REPLY":
+		return p.handleReply(message)
+	default:
+		return p.handleStateTransition(ctx, message)
+	}
+}
+
+func (p *Participant) handleStateTransition(ctx context.Context, message *Record) error {
+	if err := p.checkTransition(message); err != nil {
+		return err
+	}
+
+	handler, err := p.transitionHandler(message)
+	if err != nil {
+		return err
+	}
+
+	state := p.runStateTransition(ctx, handler, message)
+	if state != "" {
+		p.postHandleMessage(message, map[string]string{message.GetStringField("PARTITION_NAME", ""): state})
+	}
+
+	return nil
+}
+
+// batchTransition is a batch message whose transitions, one per partition of its
+// PARTITION_NAMES, are submitted to the executor on their own
+type batchTransition struct {
+	message *Record
+
+	// the message is taken by the first transition to run, see acceptBatch
+	once     sync.Once
+	accepted bool
+
+	// the transitions not done yet, and the states of the partitions done
+	remaining int
+	states    map[string]string
+
+	sync.Mutex
+}
+
+// submitBatch submits the transition of each partition of the batch message as a task of
+// its own, so that it runs in order with the other transitions of the partition, and counts
+// against the concurrency limits. It returns false if no transition is submitted.
+func (p *Participant) submitBatch(ctx context.Context, message *Record) bool {
+	batch := &batchTransition{message: message, states: map[string]string{}}
+
+	// the message is changed once taken, so the sub messages are made before any runs
+	subMessages := []*Record{}
+	for _, partition := range message.GetListField("PARTITION_NAMES") {
+		subMessages = append(subMessages, newSubMessage(message, partition))
+	}
+
+	// the transitions submitted first wait for the count of the others before they finish
+	batch.Lock()
+	defer batch.Unlock()
+
+	for _, subMessage := range subMessages {
+		subMessage, partition := subMessage, subMessage.GetStringField("PARTITION_NAME", "")
+		msgID := message.ID + "/" + partition
+
+		// the transition of each partition can be cancelled on its own
+		subCtx, cancel := context.WithCancel(ctx)
+		p.addTransition(msgID, subMessage, cancel)
+
+		submitted := p.executor.submit(&messageTask{
+			msgID:     msgID,
+			resource:  subMessage.GetStringField("RESOURCE_NAME", ""),
+			partition: partition,
+			process: func() {
+				defer p.removeTransition(msgID)
+				p.processBatchTransition(subCtx, batch, subMessage)
+			},
+		})
+		if submitted {
+			batch.remaining++
+		} else {
+			p.removeTransition(msgID)
+		}
+	}
+
+	return batch.remaining > 0
+}
+
+// acceptBatch takes the batch message, and makes sure every partition has a handler before
+// any transition runs. It returns false if the transitions are not to run.
+func (p *Participant) acceptBatch(message *Record) bool {
+	if !p.acceptMessage(message) {
+		return false
+	}
+
+	err := p.checkTransition(message)
+	for _, partition := range message.GetListField("PARTITION_NAMES") {
+		if err != nil {
+			break
+		}
+		_, err = p.transitionHandler(newSubMessage(message, partition))
+	}
+	if err != nil {
+		p.completeMessage(message, err)
+		return false
+	}
+
+	return true
+}
+
+// processBatchTransition runs the transition of one partition of the batch. The last
+// transition done updates the current states of all the partitions at once, and completes
+// the message.
+func (p *Participant) processBatchTransition(ctx context.Context, batch *batchTransition, subMessage *Record) {
+	batch.once.Do(func() {
+		batch.accepted = p.acceptBatch(batch.message)
+	})
+
+	if batch.accepted {
+		if handler, err := p.transitionHandler(subMessage); err == nil {
+			if state := p.runStateTransition(ctx, handler, subMessage); state != "" {
+				batch.Lock()
+				batch.states[subMessage.GetStringField("PARTITION_NAME", "")] = state
+				batch.Unlock()
+			}
+		}
+	}
+
+	batch.Lock()
+	batch.remaining--
+	last := batch.remaining == 0
+	batch.Unlock()
+
+	if !last {
+		return
+	}
+
+	defer p.removeTransition(batch.message.ID)
+	if !batch.accepted {
+		return
+	}
+
+	if len(batch.states) > 0 {
+		p.postHandleMessage(batch.message, batch.states)
+	}
+	p.completeMessage(batch.message, nil)
+}
+
+// newSubMessage creates the message of one partition of a batch message.
+func newSubMessage(message *Record, partition string) *Record {
+	subMessage := NewRecord(message.ID)
+	for key, value := range message.SimpleFields {
+		subMessage.SimpleFields[key] = value
+	}
+	subMessage.SetSimpleField("PARTITION_NAME", partition)
+	subMessage.SetBooleanField("BATCH_MESSAGE_MODE", false)
+
+	return subMessage
+}
+
+// transitionHandler returns the handler registered for the transition of the message,
+// or ErrTransitionNotRegistered if there is none.
+func (p *Participant) transitionHandler(message *Record) (TransitionHandler, error) {
+	stateModel := message.GetStringField("STATE_MODEL_DEF", "")
+	fromState := message.GetStringField("FROM_STATE", "")
+	toState := message.GetStringField("TO_STATE", "")
+
+	sm, ok := p.stateModel(message)
+	if !ok {
+		Logger.Printf("State model %s is not registered, cannot transit %s from %s to %s\n", stateModel, message.ID, fromState, toState)
+		return nil, ErrTransitionNotRegistered
+	}
+
+	handler := sm.handler(fromState, toState)
+	if handler == nil && strings.EqualFold(fromState, "ERROR") {
+		// a partition in ERROR can always be reset, there is nothing to undo
+		handler = func(ctx *TransitionContext) error { return nil }
+	}
+	if handler == nil {
+		Logger.Printf("State model %s has no transition from %s to %s for %s\n", stateModel, fromState, toState, message.ID)
+		return nil, ErrTransitionNotRegistered
+	}
+
+	return handler, nil
+}
 
-	fmt.Printf("State transition from %s to %s\n", fromState, toState)
+// runStateTransition runs the handler for the partition of the message, through the
+// interceptors. It returns the state of the partition after the transition: the TO_STATE,
+// ERROR if the transition failed, or empty if it was cancelled or vetoed and the partition
+// stays in the FROM_STATE.
+func (p *Participant) runStateTransition(ctx context.Context, handler TransitionHandler, message *Record) string {
+	tctx := TransitionContext{
+		MessageID:  message.ID,
+		Resource:   message.GetStringField("RESOURCE_NAME", ""),
+		Partition:  message.GetStringField("PARTITION_NAME", ""),
+		FromState:  message.GetStringField("FROM_STATE", ""),
+		ToState:    message.GetStringField("TO_STATE", ""),
+		StateModel: message.GetStringField("STATE_MODEL_DEF", ""),
+	}
 
 	// set the message execution time
 	nowMilli := time.Now().UnixNano() / 1000000
@@ -356,23 +1067,63 @@ func (p *Participant) handleStateTransition(message *Record) {
 	message.SetSimpleField("EXECUTE_START_TIMESTAMP", startTime)
 
 	p.preHandleMessage(message)
-	// TODO: invoke state model transition function
 
-	p.postHandleMessage(message)
+	// TIMEOUT is in milliseconds, and RETRY_COUNT is the number of retries after the
+	// first attempt fails
+	timeout := time.Duration(message.GetIntField("TIMEOUT", -1)) * time.Millisecond
+	retries := message.GetIntField("RETRY_COUNT", 0)
+
+	// the interceptors see the transition once, however many times the handler is retried
+	run := interceptTransition(p.interceptors, message, func(tctx *TransitionContext) error {
+		return runTransitionHandler(tctx.Context, handler, *tctx, timeout, retries)
+	})
+	tctx.Context = ctx
+
+	err := run(&tctx)
+	if err == context.Canceled {
+		// an interceptor gave up waiting on the cancelled ctx
+		err = ErrTransitionCancelled
+	}
+	if err == ErrTransitionCancelled {
+		Logger.Printf("Transition of %s from %s to %s cancelled\n", tctx.Partition, tctx.FromState, tctx.ToState)
+		p.updateStatus(message, "CANCELLED", nil)
+		return ""
+	}
+	if err == ErrTransitionVetoed {
+		Logger.Printf("Transition of %s from %s to %s vetoed\n", tctx.Partition, tctx.FromState, tctx.ToState)
+		p.updateStatus(message, "VETOED", nil)
+		return ""
+	}
+	if err != nil {
+		Logger.Printf("Transition of %s from %s to %s failed: %s\n", tctx.Partition, tctx.FromState, tctx.ToState, err.Error())
+		p.recordTransitionError(message, err)
+		p.updateStatus(message, "FAILED", err)
+		return "ERROR"
+	}
+
+	p.updateStatus(message, "COMPLETED", nil)
+
+	if strings.EqualFold(tctx.FromState, "ERROR") {
+		p.clearTransitionError(message)
+	}
+	if strings.EqualFold(tctx.ToState, "DROPPED") {
+		p.dropStateModel(tctx.Resource, tctx.Partition)
+	}
 
+	return tctx.ToState
 }
 
 func (p *Participant) preHandleMessage(message *Record) {
-
+	p.updateStatus(message, "STARTED", nil)
 }
 
-func (p *Participant) postHandleMessage(message *Record) {
+// postHandleMessage sets the current states of the partitions after the transitions of
+// the message, as partition -> state, with a single update of the current state.
+func (p *Participant) postHandleMessage(message *Record, states map[string]string) {
 	// sessionID might change when we update the state model
 	// skip if we are handling an expired session
 	sessionID := p.conn.GetSessionID()
 	targetSessionID := message.GetSimpleField("TGT_SESSION_ID")
-	toState := message.GetSimpleField("TO_STATE").(string)
-	partitionName := message.GetSimpleField("PARTITION_NAME").(string)
 
 	if targetSessionID != nil && targetSessionID.(string) != sessionID {
 		return
@@ -382,20 +1133,68 @@ func (p *Participant) postHandleMessage(message *Record) {
 	// from the current state of the instance because the resource key is dropped.
 	// In the state model it will be stayed as OFFLINE, which is OK.
 
-	if strings.ToUpper(toState) == "DROPPED" {
-		path := p.kb.currentStatesForSession(p.ParticipantID, sessionID)
-		p.conn.RemoveMapFieldKey(path, partitionName)
+	for partitionName, toState := range states {
+		if strings.ToUpper(toState) == "DROPPED" {
+			path := p.kb.currentStatesForSession(p.ParticipantID, sessionID)
+			p.conn.RemoveMapFieldKey(path, partitionName)
+		}
 	}
 
 	// actually set the current state
 	resourceID := message.GetSimpleField("RESOURCE_NAME").(string)
 	currentStateForResourcePath := p.kb.currentStateForResource(p.ParticipantID, p.conn.GetSessionID(), resourceID)
 
-	err := p.conn.UpdateMapField(currentStateForResourcePath, partitionName, "CURRENT_STATE", toState)
-	must(err)
+	err := p.retryPolicy.do(func() error {
+		return p.conn.updateRecord(currentStateForResourcePath, func(currentState *Record) {
+			for partitionName, toState := range states {
+				currentState.SetMapField(partitionName, "CURRENT_STATE", toState)
+			}
+		})
+	})
+	if err != nil {
+		p.reportError(fmt.Errorf("failed to update the current state %s: %s", currentStateForResourcePath, err.Error()))
+	}
 }
 
-func (p *Participant) watchMessages() (chan []string, chan error) {
+// recordTransitionError writes the failed transition of the partition to
+// /{cluster}/INSTANCES/{instance}/ERRORS/{session}/{resource}, keyed by partition.
+func (p *Participant) recordTransitionError(message *Record, transitionErr error) {
+	resourceID := message.GetStringField("RESOURCE_NAME", "")
+	partitionName := message.GetStringField("PARTITION_NAME", "")
+	path := p.kb.errors(p.ParticipantID, p.conn.GetSessionID(), resourceID)
+
+	if exists, _ := p.conn.Exists(path); !exists {
+		p.conn.CreateRecordWithPath(path, NewRecord(resourceID))
+	}
+
+	nowMilli := time.Now().UnixNano() / 1000000
+	err := p.conn.updateRecord(path, func(record *Record) {
+		record.RemoveMapField(partitionName)
+		record.SetMapField(partitionName, "MSG_ID", message.ID)
+		record.SetMapField(partitionName, "FROM_STATE", message.GetStringField("FROM_STATE", ""))
+		record.SetMapField(partitionName, "TO_STATE", message.GetStringField("TO_STATE", ""))
+		record.SetMapField(partitionName, "ERROR", transitionErr.Error())
+		record.SetMapField(partitionName, "TIMESTAMP", strconv.FormatInt(nowMilli, 10))
+	})
+	if err != nil {
+		Logger.Printf("Failed to record the error of %s: %s\n", partitionName, err.Error())
+	}
+}
+
+// clearTransitionError removes the error of the partition once it is reset.
+func (p *Participant) clearTransitionError(message *Record) {
+	resourceID := message.GetStringField("RESOURCE_NAME", "")
+	partitionName := message.GetStringField("PARTITION_NAME", "")
+	path := p.kb.errors(p.ParticipantID, p.conn.GetSessionID(), resourceID)
+
+	if exists, _ := p.conn.Exists(path); exists {
+		p.conn.RemoveMapFieldKey(path, partitionName)
+	}
+}
+
+// watchMessages sends a snapshot of the messages of the participant whenever they change,
+// until it fails or the stop channel is closed.
+func (p *Participant) watchMessages(stop <-chan bool) (chan []string, chan error) {
 	snapshots := make(chan []string)
 	errors := make(chan error)
 	path := p.kb.messages(p.ParticipantID)
@@ -404,13 +1203,30 @@ func (p *Participant) watchMessages() (chan []string, chan error) {
 		for {
 			snapshot, events, err := p.conn.ChildrenW(path)
 			if err != nil {
-				errors <- err
+				select {
+				case errors <- err:
+				case <-stop:
+				}
+				return
+			}
+
+			select {
+			case snapshots <- snapshot:
+			case <-stop:
+				return
+			}
+
+			var evt zk.Event
+			select {
+			case evt = <-events:
+			case <-stop:
 				return
 			}
-			snapshots <- snapshot
-			evt := <-events
 			if evt.Err != nil {
-				errors <- evt.Err
+				select {
+				case errors <- evt.Err:
+				case <-stop:
+				}
 				return
 			}
 		}
@@ -419,55 +1235,268 @@ func (p *Participant) watchMessages() (chan []string, chan error) {
 }
 
 // main event loop for the participant. It listens to the participant message in zookeeper
-// and for each update (messageChan), iterate all messages and process them
+// and for each update (messageChan), iterate all messages and hand them to the executor
 func (p *Participant) startEventLoop() {
-	// we need to keep a history of the messages that have been processed, so we don't process
-	// them again. Start a goroutine to clean up this history once every 5 seconds so it won't
-	// take too much memory
-	messageProcessedTime := make(map[string]time.Time)
+	p.executor = newMessageExecutor(p.maxConcurrentTransitions, p.resourceConcurrency)
+
+	// set when the zookeeper session expires, until a new session is established
+	expired := false
+
+	// psStarted means the message loop is running, and it can process the p.stop message
+	stop, stopped := make(chan bool), make(chan struct{})
+	p.stop, p.stopped = stop, stopped
+	p.setState(psStarted)
+
+	messagesChan, errChan := p.watchMessages(stop)
+	watching := true
+
 	go func() {
+		defer func() {
+			p.setState(psStopped)
+			close(stopped)
+		}()
+
 		for {
 			select {
-			case <-time.After(5 * time.Second):
-				for k, v := range messageProcessedTime {
-					if time.Since(v).Seconds() > 10 {
-						delete(messageProcessedTime, k)
+			case m := <-messagesChan:
+				// messageChan is a snapshot of all unprocessed messages whenever
+				// a new message is added, so it will have duplicates.
+				p.submitMessages(m)
+				continue
+			case err := <-errChan:
+				watching = false
+
+				// the watch is lost with the expired session. If the new session is
+				// already there, watch again right away
+				if err == zk.ErrSessionExpired {
+					if !expired {
+						messagesChan, errChan = p.watchMessages(stop)
+						watching = true
 					}
+					continue
 				}
-			}
-		}
-	}()
 
-	messagesChan, errChan := p.watchMessages()
+				p.reportError(fmt.Errorf("failed to watch the messages: %s", err.Error()))
+			case evt := <-p.conn.sessionEvents:
+				switch evt.State {
+				case zk.StateExpired:
+					Logger.Printf("Participant %s session expired\n", p.ParticipantID)
+					expired = true
+				case zk.StateHasSession:
+					if !expired {
+						// the watch may have run out of retries while the connection
+						// was lost, though the session is still there
+						if !watching {
+							messagesChan, errChan = p.watchMessages(stop)
+							watching = true
+						}
+						continue
+					}
+					expired = false
 
-	go func() {
-		// psStarted means the message loop is running, and
-		// it can process p.stop message
-		p.state = psStarted
+					err := p.handleNewSession()
+					if err != nil {
+						p.reportError(err)
+					}
+					if !watching {
+						messagesChan, errChan = p.watchMessages(stop)
+						watching = true
+					}
 
-		for {
-			select {
-			case m := <-messagesChan:
-				for _, msg := range m {
-					// messageChan is a snapshot of all unprocessed messages whenever
-					// a new message is added, so it will have duplicates.
-					if _, seen := messageProcessedTime[msg]; !seen {
-						p.processMessage(msg)
-						messageProcessedTime[msg] = time.Now()
+					for _, cb := range p.sessionChangeCallbacks {
+						cb(p.conn.GetSessionID(), err)
 					}
 				}
-				continue
-			case err := <-errChan:
-				fmt.Println(err.Error())
-			case <-p.stop:
-				p.state = psStopped
+			case <-stop:
 				return
 			}
 		}
 	}()
 }
 
-func (p *Participant) createLiveInstance() {
+// handleNewSession registers the participant again once a new zookeeper session replaces the
+// expired one: the ephemeral live instance went away with the old session, and the current
+// states of the old session are stale.
+func (p *Participant) handleNewSession() error {
+	Logger.Printf("Participant %s has a new session %s\n", p.ParticipantID, p.conn.GetSessionID())
+
+	// the state model definitions may have changed while the session was gone, and the
+	// partitions start over from the initial state with new state models
+	p.Lock()
+	p.stateModelDefs = map[string]*StateModelDefinition{}
+	p.partitionStateModels = map[string]*StateModel{}
+	p.Unlock()
+
+	if err := p.retryPolicy.do(p.cleanUp); err != nil {
+		return fmt.Errorf("failed to clean up the stale current states: %s", err.Error())
+	}
+
+	if err := p.createLiveInstance(); err != nil {
+		return fmt.Errorf("failed to create the live instance: %s", err.Error())
+	}
+
+	return nil
+}
+
+// submitMessages reads the messages not seen yet and submits them to the executor, oldest
+// first, so that the transitions of each partition run in the order they were sent.
+func (p *Participant) submitMessages(msgIDs []string) {
+	messages := []*Record{}
+	for _, msgID := range msgIDs {
+		message, err := p.conn.GetRecordFromPath(p.kb.message(p.ParticipantID, msgID))
+		if err != nil {
+			// the message is already processed and removed
+			continue
+		}
+
+		// a message READ is taken already, see claimMessage
+		if !strings.EqualFold(message.GetStringField("MSG_STATE", ""), "NEW") {
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].GetIntField("CREATE_TIMESTAMP", 0) < messages[j].GetIntField("CREATE_TIMESTAMP", 0)
+	})
+
+	for _, message := range messages {
+		// a cancellation must not wait behind the transition it cancels
+		if message.GetStringField("MSG_TYPE", "") == "STATE_TRANSITION_CANCELLATION" {
+			p.cancelTransition(message)
+			p.conn.DeleteTree(p.kb.message(p.ParticipantID, message.ID))
+			continue
+		}
+
+		message := message
+		ctx, cancel := context.WithCancel(context.Background())
+		if !p.addTransition(message.ID, message, cancel) {
+			// the message is already pending or running, with its own cancellation
+			cancel()
+			continue
+		}
+
+		if message.GetBooleanField("BATCH_MESSAGE_MODE", false) {
+			if !p.submitBatch(ctx, message) {
+				p.removeTransition(message.ID)
+			}
+			continue
+		}
+
+		submitted := p.executor.submit(&messageTask{
+			msgID:     message.ID,
+			resource:  message.GetStringField("RESOURCE_NAME", ""),
+			partition: message.GetStringField("PARTITION_NAME", ""),
+			process: func() {
+				defer p.removeTransition(message.ID)
+				p.processMessage(ctx, message)
+			},
+		})
+		if !submitted {
+			// the executor is stopped, or still has the message
+			p.removeTransition(message.ID)
+		}
+	}
+}
+
+// claimMessage marks the message READ for the session, with a version check against the
+// message in zookeeper. It returns false if the message is gone, or is not NEW anymore,
+// because it is taken or was rejected already.
+func (p *Participant) claimMessage(msgPath string, message *Record) (bool, error) {
+	for {
+		record, version, err := p.conn.GetRecordWithVersion(msgPath)
+		if err == zk.ErrNoNode {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if !strings.EqualFold(record.GetStringField("MSG_STATE", ""), "NEW") {
+			return false, nil
+		}
+
+		nowMilli := time.Now().UnixNano() / 1000000
+		for _, r := range []*Record{record, message} {
+			r.SetSimpleField("MSG_STATE", "READ")
+			r.SetSimpleField("READ_TIMESTAMP", strconv.FormatInt(nowMilli, 10))
+			r.SetSimpleField("EXE_SESSION_ID", p.conn.GetSessionID())
+		}
+
+		err = p.conn.SetRecordWithVersion(msgPath, record, version)
+		switch err {
+		case nil:
+			return true, nil
+		case zk.ErrNoNode:
+			return false, nil
+		case zk.ErrBadVersion:
+			// changed in the meantime, see if it is still NEW
+			continue
+		default:
+			return false, err
+		}
+	}
+}
+
+// addTransition keeps the cancel function of the message until it is processed, so that
+// a STATE_TRANSITION_CANCELLATION message can stop it, whether it is running or pending.
+// It returns false if the message is kept already.
+func (p *Participant) addTransition(msgID string, message *Record, cancel context.CancelFunc) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.transitions[msgID]; ok {
+		return false
+	}
+	p.transitions[msgID] = &pendingTransition{message: message, cancel: cancel}
+	return true
+}
+
+// cancelTransitions cancels all the pending and running transitions.
+func (p *Participant) cancelTransitions() {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, t := range p.transitions {
+		t.cancel()
+	}
+}
+
+func (p *Participant) removeTransition(msgID string) {
+	p.Lock()
+	defer p.Unlock()
+
+	if t, ok := p.transitions[msgID]; ok {
+		t.cancel()
+		delete(p.transitions, msgID)
+	}
+}
+
+// cancelTransition cancels the pending or running transition of the same resource,
+// partition, from state and to state as the cancellation message, including the transition
+// of a partition of a batch message. Nothing happens if the transition is already done.
+func (p *Participant) cancelTransition(cancellation *Record) {
+	p.Lock()
+	defer p.Unlock()
+
+	fields := []string{"RESOURCE_NAME", "PARTITION_NAME", "FROM_STATE", "TO_STATE"}
+	for _, t := range p.transitions {
+		matched := true
+		for _, field := range fields {
+			if !strings.EqualFold(t.message.GetStringField(field, ""), cancellation.GetStringField(field, "")) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			Logger.Printf("Cancelling message %s of %s\n", t.message.ID, t.message.GetStringField("PARTITION_NAME", ""))
+			t.cancel()
+		}
+	}
+}
+
+func (p *Participant) createLiveInstance() error {
 	path := p.kb.liveInstance(p.ParticipantID)
 	node := NewLiveInstanceNode(p.ParticipantID, p.conn.GetSessionID())
 	data, err := json.MarshalIndent(*node, "", "  ")
@@ -491,5 +1520,5 @@ func (p *Participant) createLiveInstance() {
 		}
 	}
 
-	must(err)
+	return err
 }
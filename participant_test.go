@@ -1,8 +1,14 @@
 package gohelix
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/yichen/go-zookeeper/zk"
 )
 
 // TestParticipantConnect makes sure the Participant.Connect
@@ -34,7 +40,7 @@ func TestParticipantConnect(t *testing.T) {
 	}
 
 	// expect the connect to fail because the auto join is not allowed
-	if p.state == psStarted {
+	if p.getState() == psStarted {
 		t.Error("Expect the participant to fail to connect")
 	}
 
@@ -51,11 +57,45 @@ func TestParticipantConnect(t *testing.T) {
 		t.Error(err)
 	}
 	defer p.Disconnect()
-	if p.state != psStarted {
+	if p.getState() != psStarted {
 		t.Error("Participant is not connected and started")
 	}
 }
 
+func TestParticipantConnectFailure(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "participant_test_TestParticipantConnectFailure_" + now.Format("20060102150405")
+
+	// the cluster is not set up yet
+	manager := NewHelixManager(testZkSvr)
+	p := manager.NewParticipant(cluster, "localhost", "12913")
+	p.RegisterStateModel(StateModelOnlineOffline, NewStateModel([]Transition{
+		{"OFFLINE", "ONLINE", nil},
+		{"ONLINE", "OFFLINE", nil},
+	}))
+
+	if err := p.Connect(); err != ErrClusterNotSetup {
+		t.Errorf("expect ErrClusterNotSetup, got %v", err)
+	}
+	if p.conn.IsConnected() {
+		t.Error("expect the connection closed")
+	}
+
+	// the state model has no handler for OFFLINE-DROPPED
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+
+	if err := p.Connect(); !errors.Is(err, ErrInvalidStateModel) {
+		t.Errorf("expect ErrInvalidStateModel, got %v", err)
+	}
+	if p.conn.IsConnected() {
+		t.Error("expect the connection closed")
+	}
+}
+
 func TestPreConnectedCallback(t *testing.T) {
 	t.Parallel()
 
@@ -97,3 +137,625 @@ func TestPreConnectedCallback(t *testing.T) {
 	}
 
 }
+
+func TestNewSubMessage(t *testing.T) {
+	t.Parallel()
+
+	message := NewRecord("msg")
+	message.SetSimpleField("MSG_TYPE", "STATE_TRANSITION")
+	message.SetSimpleField("RESOURCE_NAME", "db")
+	message.SetSimpleField("FROM_STATE", "OFFLINE")
+	message.SetSimpleField("TO_STATE", "ONLINE")
+	message.SetBooleanField("BATCH_MESSAGE_MODE", true)
+	message.SetListField("PARTITION_NAMES", []string{"db_0", "db_1"})
+
+	subMessage := newSubMessage(message, "db_1")
+	if subMessage.GetStringField("PARTITION_NAME", "") != "db_1" ||
+		subMessage.GetStringField("RESOURCE_NAME", "") != "db" ||
+		subMessage.GetStringField("TO_STATE", "") != "ONLINE" {
+		t.Errorf("wrong sub message %s", subMessage)
+	}
+	if subMessage.GetBooleanField("BATCH_MESSAGE_MODE", true) {
+		t.Error("expect the sub message not in batch mode")
+	}
+
+	// the batch message is left untouched
+	if message.GetStringField("PARTITION_NAME", "") != "" {
+		t.Errorf("expect no partition in the batch message, got %s", message.GetStringField("PARTITION_NAME", ""))
+	}
+}
+
+func TestStateModelFactory(t *testing.T) {
+	t.Parallel()
+
+	created := 0
+	p := &Participant{
+		stateModels:          map[string]*StateModel{},
+		stateModelFactories:  map[string]map[string]StateModelFactory{},
+		partitionStateModels: map[string]*StateModel{},
+	}
+	p.RegisterStateModelFactory("OnlineOffline", "DEFAULT", StateModelFactoryFunc(func(resource string, partition string) StateModel {
+		created++
+		sm := NewStateModel(nil)
+		sm.AddTransitionHandler("OFFLINE", "ONLINE", func(ctx *TransitionContext) error {
+			return nil
+		})
+		return sm
+	}))
+
+	message := NewRecord("msg")
+	message.SetSimpleField("STATE_MODEL_DEF", "OnlineOffline")
+	message.SetSimpleField("RESOURCE_NAME", "db")
+	message.SetSimpleField("PARTITION_NAME", "db_0")
+	message.SetSimpleField("FROM_STATE", "OFFLINE")
+	message.SetSimpleField("TO_STATE", "ONLINE")
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.transitionHandler(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("expect one state model for the partition, got %d", created)
+	}
+
+	message.SetSimpleField("PARTITION_NAME", "db_1")
+	if _, err := p.transitionHandler(message); err != nil {
+		t.Fatal(err)
+	}
+	if created != 2 {
+		t.Errorf("expect a state model for each partition, got %d", created)
+	}
+
+	// a dropped partition gets a new state model
+	p.dropStateModel("db", "db_0")
+	message.SetSimpleField("PARTITION_NAME", "db_0")
+	if _, err := p.transitionHandler(message); err != nil {
+		t.Fatal(err)
+	}
+	if created != 3 {
+		t.Errorf("expect a new state model once dropped, got %d", created)
+	}
+
+	// messages of another factory are not handled
+	message.SetSimpleField("STATE_MODEL_FACTORY_NAME", "other")
+	if _, err := p.transitionHandler(message); err != ErrTransitionNotRegistered {
+		t.Errorf("expect ErrTransitionNotRegistered, got %v", err)
+	}
+}
+
+func TestClaimMessage(t *testing.T) {
+	t.Parallel()
+
+	conn := newConnection(testZkSvr)
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	now := time.Now().Local()
+	cluster := "participant_test_TestClaimMessage_" + now.Format("20060102150405")
+	path := fmt.Sprintf("/%s/INSTANCES/localhost_12913/MESSAGES/msg", cluster)
+	if err := conn.ensurePathExists(path); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteTree("/" + cluster)
+
+	message := NewRecord("msg")
+	message.SetSimpleField("MSG_STATE", "new")
+	if err := conn.SetRecordForPath(path, message); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Participant{conn: conn}
+	if claimed, err := p.claimMessage(path, message); !claimed || err != nil {
+		t.Errorf("expect the NEW message claimed, got %v %v", claimed, err)
+	}
+	if message.GetStringField("MSG_STATE", "") != "READ" {
+		t.Errorf("expect the message READ, got %s", message.GetStringField("MSG_STATE", ""))
+	}
+
+	// the same message read again from another snapshot runs only once
+	again := NewRecord("msg")
+	again.SetSimpleField("MSG_STATE", "new")
+	if claimed, err := p.claimMessage(path, again); claimed || err != nil {
+		t.Errorf("expect the READ message not claimed again, got %v %v", claimed, err)
+	}
+}
+
+func TestCheckTransition(t *testing.T) {
+	t.Parallel()
+
+	r, _ := NewRecordFromBytes([]byte(HelixDefaultNodes[StateModelMasterSlave]))
+	def, err := NewStateModelDefinitionFromRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Participant{stateModelDefs: map[string]*StateModelDefinition{StateModelMasterSlave: def}}
+
+	message := NewRecord("msg")
+	message.SetSimpleField("STATE_MODEL_DEF", StateModelMasterSlave)
+	message.SetSimpleField("FROM_STATE", "OFFLINE")
+	message.SetSimpleField("TO_STATE", "SLAVE")
+	if err := p.checkTransition(message); err != nil {
+		t.Error(err)
+	}
+
+	// OFFLINE->MASTER must go through SLAVE
+	message.SetSimpleField("TO_STATE", "MASTER")
+	if err := p.checkTransition(message); err != ErrIllegalTransition {
+		t.Errorf("expect ErrIllegalTransition, got %v", err)
+	}
+}
+
+func TestHandleNewSession(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "participant_test_TestHandleNewSession_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+	a.SetConfig(cluster, "CLUSTER", map[string]string{"allowParticipantAutoJoin": "true"})
+
+	manager := NewHelixManager(testZkSvr)
+	p := manager.NewParticipant(cluster, "localhost", "12913")
+	p.RegisterStateModel("dummy", NewStateModel(nil))
+
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+
+	// the live instance goes away with the expired session, which leaves its current
+	// states behind
+	if err := p.conn.Delete(p.kb.liveInstance(p.ParticipantID)); err != nil {
+		t.Fatal(err)
+	}
+	stale := p.kb.currentStatesForSession(p.ParticipantID, "expired")
+	if err := p.conn.CreateRecordWithPath(stale+"/db", NewRecord("db")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.handleNewSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := p.conn.GetRecordFromPath(p.kb.liveInstance(p.ParticipantID))
+	if err != nil {
+		t.Fatal("expect the live instance to be created again")
+	}
+	if live.GetStringField("SESSION_ID", "") != p.conn.GetSessionID() {
+		t.Errorf("expect the live instance of the new session, got %s", live)
+	}
+
+	if exists, _ := p.conn.Exists(stale); exists {
+		t.Error("expect the current states of the expired session to be removed")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "participant_test_TestSessionExpiry_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+	a.SetConfig(cluster, "CLUSTER", map[string]string{"allowParticipantAutoJoin": "true"})
+
+	manager := NewHelixManager(testZkSvr)
+	p := manager.NewParticipant(cluster, "localhost", "12913")
+	p.RegisterStateModelFactory(StateModelOnlineOffline, "DEFAULT", StateModelFactoryFunc(func(resource string, partition string) StateModel {
+		return NewStateModel([]Transition{
+			{"OFFLINE", "ONLINE", nil},
+			{"ONLINE", "OFFLINE", nil},
+			{"OFFLINE", "DROPPED", nil},
+		})
+	}))
+
+	sessions := make(chan string, 1)
+	p.AddSessionChangeCallback(func(sessionID string, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		sessions <- sessionID
+	})
+
+	// the session events of the connection come from the test
+	events := make(chan zk.Event)
+	p.conn = newConnection(testZkSvr)
+	if err := p.conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	p.conn.sessionEvents = events
+
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+
+	// the factory creates the state model of db_0, which leaves OFFLINE
+	liveInstance := NewLiveInstanceNode(p.ParticipantID, p.conn.GetSessionID())
+	message := newStateTransitionMessage("controller", "", liveInstance, "db", "db_0", StateModelOnlineOffline, "DEFAULT",
+		stateTransition{instance: p.ParticipantID, fromState: "OFFLINE", toState: "ONLINE"})
+	if _, err := p.transitionHandler(message); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.conn.Delete(p.kb.liveInstance(p.ParticipantID)); err != nil {
+		t.Fatal(err)
+	}
+	events <- zk.Event{State: zk.StateExpired}
+	events <- zk.Event{State: zk.StateHasSession}
+
+	select {
+	case sessionID := <-sessions:
+		if sessionID != p.conn.GetSessionID() {
+			t.Errorf("expect session %s, got %s", p.conn.GetSessionID(), sessionID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the session change callback")
+	}
+
+	if exists, _ := p.conn.Exists(p.kb.liveInstance(p.ParticipantID)); !exists {
+		t.Error("expect the live instance created again")
+	}
+
+	// the partitions start over from OFFLINE, with new state models
+	p.Lock()
+	if len(p.partitionStateModels) != 0 {
+		t.Errorf("expect the state models of the partitions dropped, got %v", p.partitionStateModels)
+	}
+	p.Unlock()
+}
+
+func TestBatchStateTransition(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "participant_test_TestBatchStateTransition_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+	a.SetConfig(cluster, "CLUSTER", map[string]string{"allowParticipantAutoJoin": "true"})
+
+	manager := NewHelixManager(testZkSvr)
+	p := manager.NewParticipant(cluster, "localhost", "12913")
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	sm := NewStateModel(nil)
+	sm.AddTransitionHandler("OFFLINE", "ONLINE", func(ctx *TransitionContext) error {
+		lock.Lock()
+		if running++; running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return nil
+	})
+	sm.AddTransition("ONLINE", "OFFLINE", nil)
+	sm.AddTransition("OFFLINE", "DROPPED", nil)
+	p.RegisterStateModel(StateModelOnlineOffline, sm)
+	p.SetResourceConcurrency("db", 1)
+
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+
+	partitions := []string{"db_0", "db_1", "db_2", "db_3"}
+	liveInstance := NewLiveInstanceNode(p.ParticipantID, p.conn.GetSessionID())
+	message := newStateTransitionMessage("controller", "", liveInstance, "db", "", StateModelOnlineOffline, "DEFAULT",
+		stateTransition{instance: p.ParticipantID, fromState: "OFFLINE", toState: "ONLINE"})
+	message.SetBooleanField("BATCH_MESSAGE_MODE", true)
+	message.SetListField("PARTITION_NAMES", partitions)
+	if err := p.conn.CreateRecordWithPath(p.kb.message(p.ParticipantID, message.ID), message); err != nil {
+		t.Fatal(err)
+	}
+
+	path := p.kb.currentStateForResource(p.ParticipantID, p.conn.GetSessionID(), "db")
+	done := waitUntil(5*time.Second, func() bool {
+		currentState, err := p.conn.GetRecordFromPath(path)
+		if err != nil {
+			return false
+		}
+		for _, partition := range partitions {
+			if currentState.GetMapField(partition, "CURRENT_STATE") != "ONLINE" {
+				return false
+			}
+		}
+		return true
+	})
+	if !done {
+		t.Fatal("expect every partition of the batch ONLINE")
+	}
+
+	// the transitions of the batch count against the concurrency limit of the resource
+	lock.Lock()
+	if maxRunning != 1 {
+		t.Errorf("expect one transition of db at a time, got %d", maxRunning)
+	}
+	lock.Unlock()
+
+	if !waitUntil(time.Second, func() bool {
+		exists, _ := p.conn.Exists(p.kb.message(p.ParticipantID, message.ID))
+		return !exists
+	}) {
+		t.Error("expect the batch message removed once processed")
+	}
+}
+
+func TestParticipantShutdown(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "participant_test_TestParticipantShutdown_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+	a.SetConfig(cluster, "CLUSTER", map[string]string{"allowParticipantAutoJoin": "true"})
+
+	manager := NewHelixManager(testZkSvr)
+	p := manager.NewParticipant(cluster, "localhost", "12913")
+
+	// the handler only returns a while after it is cancelled
+	started := make(chan struct{})
+	var lock sync.Mutex
+	returned := false
+	sm := NewStateModel(nil)
+	sm.AddTransitionHandler("OFFLINE", "ONLINE", func(ctx *TransitionContext) error {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(200 * time.Millisecond)
+
+		lock.Lock()
+		returned = true
+		lock.Unlock()
+		return ctx.Err()
+	})
+	sm.AddTransition("ONLINE", "OFFLINE", nil)
+	sm.AddTransition("OFFLINE", "DROPPED", nil)
+	p.RegisterStateModel(StateModelOnlineOffline, sm)
+
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+
+	liveInstance := NewLiveInstanceNode(p.ParticipantID, p.conn.GetSessionID())
+	message := newStateTransitionMessage("controller", "", liveInstance, "db", "db_0", StateModelOnlineOffline, "DEFAULT",
+		stateTransition{instance: p.ParticipantID, fromState: "OFFLINE", toState: "ONLINE"})
+	if err := p.conn.CreateRecordWithPath(p.kb.message(p.ParticipantID, message.ID), message); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the transition to start")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expect the shutdown to time out, got %v", err)
+	}
+
+	// the cancelled handler returns before the participant disconnects
+	lock.Lock()
+	if !returned {
+		t.Error("expect the cancelled transition to return before the shutdown")
+	}
+	lock.Unlock()
+
+	if p.getState() != psDisconnected {
+		t.Error("expect the participant disconnected")
+	}
+
+	conn := newConnection(testZkSvr)
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	if exists, _ := conn.Exists(p.kb.liveInstance(p.ParticipantID)); exists {
+		t.Error("expect the live instance removed")
+	}
+}
+
+func TestStateModelDefChange(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "participant_test_TestStateModelDefChange_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+	a.SetConfig(cluster, "CLUSTER", map[string]string{"allowParticipantAutoJoin": "true"})
+
+	manager := NewHelixManager(testZkSvr)
+	p := manager.NewParticipant(cluster, "localhost", "12913")
+	p.RegisterStateModel(StateModelOnlineOffline, NewStateModel([]Transition{
+		{"OFFLINE", "ONLINE", nil},
+		{"ONLINE", "OFFLINE", nil},
+		{"OFFLINE", "DROPPED", nil},
+	}))
+
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+
+	def, err := p.stateModelDef(StateModelOnlineOffline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.AllowsTransition("ONLINE", "DROPPED") {
+		t.Fatal("expect ONLINE-DROPPED not allowed yet")
+	}
+
+	// the cached definition goes away once the definition changes in zookeeper
+	changed, _ := NewStateModelDefinitionBuilder(StateModelOnlineOffline).
+		AddState("ONLINE", "R").
+		AddState("OFFLINE", "").
+		AddState("DROPPED", "").
+		InitialState("OFFLINE").
+		AddTransition("OFFLINE", "ONLINE").
+		AddTransition("ONLINE", "OFFLINE").
+		AddTransition("OFFLINE", "DROPPED").
+		AddTransition("ONLINE", "DROPPED").
+		Build()
+	if err := p.conn.SetRecordForPath(p.kb.stateModel(StateModelOnlineOffline), changed.Record()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitUntil(5*time.Second, func() bool {
+		def, err := p.stateModelDef(StateModelOnlineOffline)
+		return err == nil && def.AllowsTransition("ONLINE", "DROPPED")
+	}) {
+		t.Error("expect the changed definition read again")
+	}
+}
+
+func TestParticipantDisconnect(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "participant_test_TestParticipantDisconnect_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+	a.SetConfig(cluster, "CLUSTER", map[string]string{"allowParticipantAutoJoin": "true"})
+
+	manager := NewHelixManager(testZkSvr)
+	p := manager.NewParticipant(cluster, "localhost", "12913")
+
+	started := make(chan struct{})
+	var lock sync.Mutex
+	returned := false
+	sm := NewStateModel(nil)
+	sm.AddTransitionHandler("OFFLINE", "ONLINE", func(ctx *TransitionContext) error {
+		close(started)
+		<-ctx.Done()
+
+		lock.Lock()
+		returned = true
+		lock.Unlock()
+		return ctx.Err()
+	})
+	sm.AddTransition("ONLINE", "OFFLINE", nil)
+	sm.AddTransition("OFFLINE", "DROPPED", nil)
+	p.RegisterStateModel(StateModelOnlineOffline, sm)
+
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	liveInstance := NewLiveInstanceNode(p.ParticipantID, p.conn.GetSessionID())
+	message := newStateTransitionMessage("controller", "", liveInstance, "db", "db_0", StateModelOnlineOffline, "DEFAULT",
+		stateTransition{instance: p.ParticipantID, fromState: "OFFLINE", toState: "ONLINE"})
+	if err := p.conn.CreateRecordWithPath(p.kb.message(p.ParticipantID, message.ID), message); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the transition to start")
+	}
+
+	// the running transition is cancelled, and returns before the connection closes
+	p.Disconnect()
+
+	lock.Lock()
+	if !returned {
+		t.Error("expect the transition cancelled and returned on disconnect")
+	}
+	lock.Unlock()
+}
+
+func TestCancelBatchTransition(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Local()
+	cluster := "participant_test_TestCancelBatchTransition_" + now.Format("20060102150405")
+
+	a := Admin{zkSvr: testZkSvr}
+	a.AddCluster(cluster)
+	defer a.DropCluster(cluster)
+	a.SetConfig(cluster, "CLUSTER", map[string]string{"allowParticipantAutoJoin": "true"})
+
+	manager := NewHelixManager(testZkSvr)
+	p := manager.NewParticipant(cluster, "localhost", "12913")
+
+	// db_0 runs until it is cancelled, db_1 right away
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	sm := NewStateModel(nil)
+	sm.AddTransitionHandler("OFFLINE", "ONLINE", func(ctx *TransitionContext) error {
+		if ctx.Partition != "db_0" {
+			return nil
+		}
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	})
+	sm.AddTransition("ONLINE", "OFFLINE", nil)
+	sm.AddTransition("OFFLINE", "DROPPED", nil)
+	p.RegisterStateModel(StateModelOnlineOffline, sm)
+
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+
+	liveInstance := NewLiveInstanceNode(p.ParticipantID, p.conn.GetSessionID())
+	transition := stateTransition{instance: p.ParticipantID, fromState: "OFFLINE", toState: "ONLINE"}
+	message := newStateTransitionMessage("controller", "", liveInstance, "db", "", StateModelOnlineOffline, "DEFAULT", transition)
+	message.SetBooleanField("BATCH_MESSAGE_MODE", true)
+	message.SetListField("PARTITION_NAMES", []string{"db_0", "db_1"})
+	if err := p.conn.CreateRecordWithPath(p.kb.message(p.ParticipantID, message.ID), message); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the transition of db_0 to start")
+	}
+
+	cancellation := newStateTransitionMessage("controller", "", liveInstance, "db", "db_0", StateModelOnlineOffline, "DEFAULT", transition)
+	cancellation.SetSimpleField("MSG_TYPE", "STATE_TRANSITION_CANCELLATION")
+	if err := p.conn.CreateRecordWithPath(p.kb.message(p.ParticipantID, cancellation.ID), cancellation); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the transition of db_0 cancelled")
+	}
+
+	// the other partition of the batch is done all the same
+	path := p.kb.currentStateForResource(p.ParticipantID, p.conn.GetSessionID(), "db")
+	if !waitUntil(5*time.Second, func() bool {
+		currentState, err := p.conn.GetRecordFromPath(path)
+		return err == nil && currentState.GetMapField("db_1", "CURRENT_STATE") == "ONLINE"
+	}) {
+		t.Error("expect db_1 ONLINE")
+	}
+}
@@ -0,0 +1,488 @@
+package gohelix
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/yichen/go-zookeeper/zk"
+)
+
+// the stages run by the leader controller for every cluster change
+var defaultPipeline = []pipelineStage{
+	readClusterDataStage,
+	bestPossibleStateStage,
+	messageGenerationStage,
+	externalViewStage,
+}
+
+// clusterDataCache is a snapshot of the cluster read at the beginning of a pipeline run
+type clusterDataCache struct {
+	idealStates     map[string]*Record
+	liveInstances   map[string]*Record
+	instanceConfigs map[string]*Record
+	stateModelDefs  map[string]*StateModelDefinition
+	externalViews   map[string]*Record
+
+	// instance -> resource -> current state in the session of the live instance
+	currentStates map[string]map[string]*Record
+
+	// instance -> messages not yet processed by the instance
+	messages map[string][]*Record
+}
+
+func newClusterDataCache() *clusterDataCache {
+	return &clusterDataCache{
+		idealStates:     map[string]*Record{},
+		liveInstances:   map[string]*Record{},
+		instanceConfigs: map[string]*Record{},
+		stateModelDefs:  map[string]*StateModelDefinition{},
+		externalViews:   map[string]*Record{},
+		currentStates:   map[string]map[string]*Record{},
+		messages:        map[string][]*Record{},
+	}
+}
+
+func (cache *clusterDataCache) isInstanceEnabled(instance string) bool {
+	config, ok := cache.instanceConfigs[instance]
+	if !ok {
+		return true
+	}
+
+	return config.GetBooleanField("HELIX_ENABLED", true)
+}
+
+func (cache *clusterDataCache) liveEnabledInstances() int {
+	count := 0
+	for instance := range cache.liveInstances {
+		if cache.isInstanceEnabled(instance) {
+			count++
+		}
+	}
+	return count
+}
+
+// replicas returns the number of replicas of the resource set in the ideal state.
+// ANY_LIVEINSTANCE means a replica on every live and enabled instance.
+func (cache *clusterDataCache) replicas(idealState *Record) int {
+	if idealState.GetStringField("REPLICAS", "") == "ANY_LIVEINSTANCE" {
+		return cache.liveEnabledInstances()
+	}
+
+	return idealState.GetIntField("REPLICAS", 0)
+}
+
+// currentState returns the state of the partition on the instance, empty if the
+// instance does not hold the partition.
+func (cache *clusterDataCache) currentState(instance string, resource string, partition string) string {
+	cs := cache.currentStates[instance][resource]
+	if cs == nil {
+		return ""
+	}
+
+	return cs.GetMapField(partition, "CURRENT_STATE")
+}
+
+// pendingMessage returns the state transition message of the partition that the
+// instance has not processed yet, nil if there is none. A message the instance
+// marked unprocessable is not pending: it will never be processed.
+func (cache *clusterDataCache) pendingMessage(instance string, resource string, partition string) *Record {
+	for _, msg := range cache.messages[instance] {
+		if msg.GetStringField("MSG_TYPE", "") == "STATE_TRANSITION" &&
+			msg.GetStringField("MSG_STATE", "") != "unprocessable" &&
+			msg.GetStringField("RESOURCE_NAME", "") == resource &&
+			(msg.GetStringField("PARTITION_NAME", "") == partition || strSliceContains(msg.GetListField("PARTITION_NAMES"), partition)) {
+			return msg
+		}
+	}
+
+	return nil
+}
+
+// partitions returns the sorted partitions of the resource, known either from the
+// ideal state or from the current state of the live instances.
+func (cache *clusterDataCache) partitions(resource string, idealState *Record) []string {
+	seen := map[string]bool{}
+	if idealState != nil {
+		for p := range idealState.ListFields {
+			seen[p] = true
+		}
+		for p := range idealState.MapFields {
+			seen[p] = true
+		}
+	}
+
+	for instance := range cache.liveInstances {
+		if cs := cache.currentStates[instance][resource]; cs != nil {
+			for p := range cs.MapFields {
+				seen[p] = true
+			}
+		}
+	}
+
+	partitions := make([]string, 0, len(seen))
+	for p := range seen {
+		partitions = append(partitions, p)
+	}
+	sort.Strings(partitions)
+
+	return partitions
+}
+
+// stateModelDef returns the state model definition of the resource. For a resource
+// dropped from the ideal states, the definition is found from the current states.
+func (cache *clusterDataCache) stateModelDef(resource string) *StateModelDefinition {
+	if is, ok := cache.idealStates[resource]; ok {
+		return cache.stateModelDefs[is.GetStringField("STATE_MODEL_DEF_REF", "")]
+	}
+
+	for _, resources := range cache.currentStates {
+		if cs, ok := resources[resource]; ok {
+			return cache.stateModelDefs[cs.GetStringField("STATE_MODEL_DEF", "")]
+		}
+	}
+
+	return nil
+}
+
+// readClusterDataStage reads the ideal states, the state model definitions, the external
+// views and the live instances with their current states and messages. It also makes
+// sure the controller watches them, so that any change triggers another pipeline run.
+func readClusterDataStage(c *Controller, event *clusterEvent) error {
+	cache := newClusterDataCache()
+
+	resources, err := c.conn.Children(c.kb.idealStates())
+	if err != nil {
+		return err
+	}
+	for _, resource := range resources {
+		path := c.kb.idealStateForResource(resource)
+		record, err := c.conn.GetRecordFromPath(path)
+		if err == zk.ErrNoNode {
+			// dropped in the meantime
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		cache.idealStates[resource] = record
+		c.watchData(event.term, path, idealStateChanged)
+	}
+
+	models, err := c.conn.Children(c.kb.stateModels())
+	if err != nil {
+		return err
+	}
+	for _, model := range models {
+		record, err := c.conn.GetRecordFromPath(c.kb.stateModel(model))
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		def, err := NewStateModelDefinitionFromRecord(record)
+		if err != nil {
+			// the resources of the state model are left alone, rather than every resource
+			Logger.Printf("Skipping state model %s: %s\n", model, err.Error())
+			continue
+		}
+		cache.stateModelDefs[model] = def
+	}
+
+	views, err := c.conn.Children(c.kb.externalView())
+	if err != nil {
+		return err
+	}
+	for _, resource := range views {
+		record, err := c.conn.GetRecordFromPath(c.kb.externalViewForResource(resource))
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		cache.externalViews[resource] = record
+	}
+
+	instances, err := c.conn.Children(c.kb.liveInstances())
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if err := c.readInstanceData(event.term, cache, instance); err != nil {
+			return err
+		}
+	}
+
+	event.cache = cache
+	return nil
+}
+
+func (c *Controller) readInstanceData(term *leaderTerm, cache *clusterDataCache, instance string) error {
+	live, err := c.conn.GetRecordFromPath(c.kb.liveInstance(instance))
+	if err == zk.ErrNoNode {
+		// the instance went away in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cache.liveInstances[instance] = live
+
+	configPath := c.kb.participantConfig(instance)
+	config, err := c.conn.GetRecordFromPath(configPath)
+	if err != nil && err != zk.ErrNoNode {
+		return err
+	}
+	if err == nil {
+		cache.instanceConfigs[instance] = config
+		c.watchData(term, configPath, instanceConfigChanged)
+	}
+
+	sessionID := live.GetStringField("SESSION_ID", "")
+	sessionPath := c.kb.currentStatesForSession(instance, sessionID)
+	cache.currentStates[instance] = map[string]*Record{}
+
+	// the session path is created with the first state transition of the instance
+	resources, err := c.conn.Children(sessionPath)
+	if err != nil && err != zk.ErrNoNode {
+		return err
+	}
+	if err == nil {
+		c.watchChildren(term, sessionPath, currentStateChanged)
+	}
+	for _, resource := range resources {
+		path := c.kb.currentStateForResource(instance, sessionID, resource)
+		record, err := c.conn.GetRecordFromPath(path)
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		cache.currentStates[instance][resource] = record
+		c.watchData(term, path, currentStateChanged)
+	}
+
+	messagesPath := c.kb.messages(instance)
+	messages, err := c.conn.Children(messagesPath)
+	if err != nil && err != zk.ErrNoNode {
+		return err
+	}
+	if err == nil {
+		c.watchChildren(term, messagesPath, instanceMessagesChanged)
+	}
+	for _, msgID := range messages {
+		record, err := c.conn.GetRecordFromPath(c.kb.message(instance, msgID))
+		if err == zk.ErrNoNode {
+			// processed in the meantime
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// the instance rejected the message, remove it so that the transition is retried
+		if record.GetStringField("MSG_STATE", "") == "unprocessable" {
+			c.conn.DeleteTree(c.kb.message(instance, msgID))
+			continue
+		}
+
+		cache.messages[instance] = append(cache.messages[instance], record)
+	}
+
+	return nil
+}
+
+// bestPossibleStateStage computes the state every partition should be in, given the
+// ideal state and the instances currently alive.
+func bestPossibleStateStage(c *Controller, event *clusterEvent) error {
+	cache := event.cache
+	result := map[string]map[string]map[string]string{}
+
+	for resource, idealState := range cache.idealStates {
+		def := cache.stateModelDef(resource)
+		if def == nil {
+			Logger.Printf("State model %s of resource %s does not exist\n", idealState.GetStringField("STATE_MODEL_DEF_REF", ""), resource)
+			continue
+		}
+
+		// a disabled resource goes back to the initial state everywhere
+		if !idealState.GetBooleanField("HELIX_ENABLED", true) {
+			result[resource] = computeStatesForAllHolders(resource, def.InitialState, cache)
+			continue
+		}
+
+		mode := idealState.GetStringField("REBALANCE_MODE", "SEMI_AUTO")
+		r, ok := rebalancers[mode]
+		if !ok {
+			Logger.Printf("Rebalance mode %s of resource %s is not supported\n", mode, resource)
+			continue
+		}
+
+		result[resource] = r.computeBestPossibleState(resource, idealState, def, cache)
+	}
+
+	// resources removed from the ideal states are dropped from the instances
+	for _, resources := range cache.currentStates {
+		for resource := range resources {
+			if _, ok := result[resource]; ok {
+				continue
+			}
+			if _, ok := cache.idealStates[resource]; ok {
+				continue
+			}
+
+			result[resource] = computeStatesForAllHolders(resource, "DROPPED", cache)
+		}
+	}
+
+	event.bestPossibleState = result
+	return nil
+}
+
+// computeStatesForAllHolders moves every live instance holding a partition of the
+// resource to the given state. A partition in ERROR only moves when it is dropped.
+func computeStatesForAllHolders(resource string, state string, cache *clusterDataCache) map[string]map[string]string {
+	result := map[string]map[string]string{}
+
+	for _, partition := range cache.partitions(resource, nil) {
+		result[partition] = map[string]string{}
+		for instance := range cache.liveInstances {
+			current := cache.currentState(instance, resource, partition)
+			if current == "" || current == "DROPPED" || (current == "ERROR" && state != "DROPPED") {
+				continue
+			}
+			result[partition][instance] = state
+		}
+	}
+
+	return result
+}
+
+// messageGenerationStage sends the state transition messages that bring the current
+// state of every partition one hop closer to its best possible state.
+func messageGenerationStage(c *Controller, event *clusterEvent) error {
+	cache := event.cache
+
+	for resource, partitions := range event.bestPossibleState {
+		def := cache.stateModelDef(resource)
+		if def == nil {
+			continue
+		}
+
+		factoryName := "DEFAULT"
+		if is, ok := cache.idealStates[resource]; ok {
+			factoryName = is.GetStringField("STATE_MODEL_FACTORY_NAME", factoryName)
+		}
+
+		for partition, bestPossible := range partitions {
+			for _, t := range computeTransitions(resource, partition, bestPossible, def, cache) {
+				msg := newStateTransitionMessage(c.ControllerID, c.conn.GetSessionID(), cache.liveInstances[t.instance], resource, partition, def.Name, factoryName, t)
+				if err := c.conn.CreateRecordWithPath(c.kb.message(t.instance, msg.ID), msg); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// stateTransition is a transition the controller asks an instance to make
+type stateTransition struct {
+	instance  string
+	fromState string
+	toState   string
+}
+
+// computeTransitions returns the transitions that bring the partition one hop closer
+// to its best possible state. Instances that still have a message of the partition to
+// process are left alone, and no instance enters a state like MASTER before the instance
+// leaving it is done, so the count constraints of the state model always hold.
+func computeTransitions(resource string, partition string, bestPossible map[string]string, def *StateModelDefinition, cache *clusterDataCache) []stateTransition {
+	// count the instances in each state, including the states they are transiting to
+	stateCounts := map[string]int{}
+	for instance := range cache.liveInstances {
+		if current := cache.currentState(instance, resource, partition); current != "" {
+			stateCounts[current]++
+		}
+		if msg := cache.pendingMessage(instance, resource, partition); msg != nil {
+			stateCounts[msg.GetStringField("TO_STATE", "")]++
+		}
+	}
+
+	instances := make([]string, 0, len(bestPossible))
+	for instance := range bestPossible {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+
+	transitions := []stateTransition{}
+	for _, instance := range instances {
+		if _, live := cache.liveInstances[instance]; !live {
+			continue
+		}
+
+		desired := bestPossible[instance]
+		current := cache.currentState(instance, resource, partition)
+		if current == "" {
+			current = def.InitialState
+		}
+
+		// a partition in ERROR stays there until it is reset or dropped
+		if current == desired || (current == "ERROR" && desired != "DROPPED") {
+			continue
+		}
+
+		if cache.pendingMessage(instance, resource, partition) != nil {
+			continue
+		}
+
+		next := def.NextState(current, desired)
+		if next == "" {
+			Logger.Printf("No transition from %s to %s in state model %s for %s\n", current, desired, def.Name, partition)
+			continue
+		}
+
+		if bound := def.upperBound(next); bound > 0 && stateCounts[next] >= bound {
+			// wait for the instance holding the state to leave it first
+			continue
+		}
+
+		stateCounts[next]++
+		transitions = append(transitions, stateTransition{instance, current, next})
+	}
+
+	return transitions
+}
+
+// newStateTransitionMessage creates a STATE_TRANSITION message from the source, usually
+// the controller, to the live instance, in the format the participant processes.
+func newStateTransitionMessage(srcName string, srcSessionID string, liveInstance *Record, resource string, partition string, stateModel string, factoryName string, t stateTransition) *Record {
+	msgID := newUUID()
+	nowMilli := time.Now().UnixNano() / 1000000
+
+	msg := NewRecord(msgID)
+	msg.SetSimpleField("MSG_ID", msgID)
+	msg.SetSimpleField("MSG_TYPE", "STATE_TRANSITION")
+	msg.SetSimpleField("MSG_STATE", "new")
+	msg.SetSimpleField("CREATE_TIMESTAMP", strconv.FormatInt(nowMilli, 10))
+	msg.SetSimpleField("SRC_NAME", srcName)
+	msg.SetSimpleField("SRC_SESSION_ID", srcSessionID)
+	msg.SetSimpleField("TGT_NAME", t.instance)
+	msg.SetSimpleField("TGT_SESSION_ID", liveInstance.GetStringField("SESSION_ID", ""))
+	msg.SetSimpleField("FROM_STATE", t.fromState)
+	msg.SetSimpleField("TO_STATE", t.toState)
+	msg.SetSimpleField("RESOURCE_NAME", resource)
+	msg.SetSimpleField("PARTITION_NAME", partition)
+	msg.SetSimpleField("STATE_MODEL_DEF", stateModel)
+	msg.SetSimpleField("STATE_MODEL_FACTORY_NAME", factoryName)
+
+	return msg
+}
@@ -0,0 +1,153 @@
+package gohelix
+
+import (
+	"testing"
+)
+
+func getTestClusterDataCache(liveInstances ...string) *clusterDataCache {
+	cache := newClusterDataCache()
+	for _, instance := range liveInstances {
+		cache.liveInstances[instance] = NewLiveInstanceNode(instance, "1")
+		cache.currentStates[instance] = map[string]*Record{}
+	}
+
+	return cache
+}
+
+func setTestCurrentState(cache *clusterDataCache, instance string, resource string, partition string, state string) {
+	if cache.currentStates[instance][resource] == nil {
+		cache.currentStates[instance][resource] = NewRecord(resource)
+	}
+	cache.currentStates[instance][resource].SetMapField(partition, "CURRENT_STATE", state)
+}
+
+func TestComputeStatesFromPreferenceList(t *testing.T) {
+	t.Parallel()
+
+	def := getTestStateModelDef(t, StateModelMasterSlave)
+	cache := getTestClusterDataCache("a", "b", "c")
+
+	states := computeStatesFromPreferenceList("db", "db_0", []string{"a", "b", "c"}, 3, def, cache)
+	if states["a"] != "MASTER" || states["b"] != "SLAVE" || states["c"] != "SLAVE" {
+		t.Errorf("wrong best possible state %v", states)
+	}
+
+	// the next instance in the list takes over the master
+	delete(cache.liveInstances, "a")
+	states = computeStatesFromPreferenceList("db", "db_0", []string{"a", "b", "c"}, 3, def, cache)
+	if _, ok := states["a"]; ok || states["b"] != "MASTER" || states["c"] != "SLAVE" {
+		t.Errorf("wrong best possible state %v", states)
+	}
+
+	// an instance holding the partition without being on the list drops it
+	cache = getTestClusterDataCache("a", "b", "c")
+	setTestCurrentState(cache, "c", "db", "db_0", "SLAVE")
+	states = computeStatesFromPreferenceList("db", "db_0", []string{"a", "b"}, 2, def, cache)
+	if states["a"] != "MASTER" || states["b"] != "SLAVE" || states["c"] != "DROPPED" {
+		t.Errorf("wrong best possible state %v", states)
+	}
+}
+
+func TestComputeTransitions(t *testing.T) {
+	t.Parallel()
+
+	def := getTestStateModelDef(t, StateModelMasterSlave)
+	cache := getTestClusterDataCache("a", "b")
+	bestPossible := map[string]string{"a": "MASTER", "b": "SLAVE"}
+
+	// OFFLINE->MASTER goes through SLAVE first
+	transitions := computeTransitions("db", "db_0", bestPossible, def, cache)
+	if len(transitions) != 2 {
+		t.Fatalf("expect 2 transitions, got %v", transitions)
+	}
+	for _, tr := range transitions {
+		if tr.fromState != "OFFLINE" || tr.toState != "SLAVE" {
+			t.Errorf("wrong transition %v", tr)
+		}
+	}
+
+	// no new message while one is pending
+	msg := NewRecord("msg")
+	msg.SetSimpleField("MSG_TYPE", "STATE_TRANSITION")
+	msg.SetSimpleField("RESOURCE_NAME", "db")
+	msg.SetSimpleField("PARTITION_NAME", "db_0")
+	msg.SetSimpleField("TO_STATE", "SLAVE")
+	cache.messages["a"] = []*Record{msg}
+	setTestCurrentState(cache, "b", "db", "db_0", "SLAVE")
+	if transitions = computeTransitions("db", "db_0", bestPossible, def, cache); len(transitions) != 0 {
+		t.Errorf("expect no transition, got %v", transitions)
+	}
+
+	// the new master waits for the old one to step down
+	cache = getTestClusterDataCache("a", "b")
+	setTestCurrentState(cache, "a", "db", "db_0", "MASTER")
+	setTestCurrentState(cache, "b", "db", "db_0", "SLAVE")
+	bestPossible = map[string]string{"a": "SLAVE", "b": "MASTER"}
+	transitions = computeTransitions("db", "db_0", bestPossible, def, cache)
+	if len(transitions) != 1 || transitions[0] != (stateTransition{"a", "MASTER", "SLAVE"}) {
+		t.Errorf("expect MASTER->SLAVE on a only, got %v", transitions)
+	}
+
+	// the next hops come from the {STATE}.next map fields of the definition
+	def = getTestStateModelDef(t, "STORAGE_DEFAULT_SM_SCHEMATA")
+	cache = getTestClusterDataCache("a")
+	setTestCurrentState(cache, "a", "db", "db_0", "OFFLINE")
+	transitions = computeTransitions("db", "db_0", map[string]string{"a": "DROPPED"}, def, cache)
+	if len(transitions) != 1 || transitions[0] != (stateTransition{"a", "OFFLINE", "DROPPED"}) {
+		t.Errorf("expect OFFLINE->DROPPED on a, got %v", transitions)
+	}
+}
+
+func TestComputeTransitionsFromError(t *testing.T) {
+	t.Parallel()
+
+	def := getTestStateModelDef(t, StateModelMasterSlave)
+	cache := getTestClusterDataCache("a", "b")
+	setTestCurrentState(cache, "a", "db", "db_0", "ERROR")
+	setTestCurrentState(cache, "b", "db", "db_0", "SLAVE")
+
+	// a partition in ERROR is dropped along with its resource
+	states := computeStatesForAllHolders("db", "DROPPED", cache)
+	if states["db_0"]["a"] != "DROPPED" || states["db_0"]["b"] != "DROPPED" {
+		t.Fatalf("wrong best possible state %v", states)
+	}
+	transitions := computeTransitions("db", "db_0", states["db_0"], def, cache)
+	if len(transitions) != 2 || transitions[0] != (stateTransition{"a", "ERROR", "DROPPED"}) {
+		t.Errorf("expect ERROR->DROPPED on a, got %v", transitions)
+	}
+
+	// but otherwise stays there until it is reset
+	states = computeStatesForAllHolders("db", def.InitialState, cache)
+	if _, ok := states["db_0"]["a"]; ok || states["db_0"]["b"] != "OFFLINE" {
+		t.Errorf("wrong best possible state %v", states)
+	}
+	transitions = computeTransitions("db", "db_0", map[string]string{"a": "OFFLINE"}, def, cache)
+	if len(transitions) != 0 {
+		t.Errorf("expect no transition, got %v", transitions)
+	}
+}
+
+func TestUnprocessableMessageNotPending(t *testing.T) {
+	t.Parallel()
+
+	def := getTestStateModelDef(t, StateModelMasterSlave)
+	cache := getTestClusterDataCache("a")
+
+	msg := NewRecord("msg")
+	msg.SetSimpleField("MSG_TYPE", "STATE_TRANSITION")
+	msg.SetSimpleField("MSG_STATE", "unprocessable")
+	msg.SetSimpleField("RESOURCE_NAME", "db")
+	msg.SetSimpleField("PARTITION_NAME", "db_0")
+	msg.SetSimpleField("TO_STATE", "MASTER")
+	cache.messages["a"] = []*Record{msg}
+
+	if pending := cache.pendingMessage("a", "db", "db_0"); pending != nil {
+		t.Errorf("expect no pending message, got %s", pending)
+	}
+
+	// the rejected message neither holds the instance back nor counts toward MASTER
+	transitions := computeTransitions("db", "db_0", map[string]string{"a": "SLAVE"}, def, cache)
+	if len(transitions) != 1 || transitions[0] != (stateTransition{"a", "OFFLINE", "SLAVE"}) {
+		t.Errorf("expect OFFLINE->SLAVE on a, got %v", transitions)
+	}
+}
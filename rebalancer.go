@@ -0,0 +1,15 @@
+package gohelix
+
+// rebalancer computes the best possible state of the partitions of a resource, as a
+// map of partition -> instance -> state. The controller then sends the state
+// transition messages that bring the current state toward it.
+type rebalancer interface {
+	computeBestPossibleState(resource string, idealState *Record, def *StateModelDefinition, cache *clusterDataCache) map[string]map[string]string
+}
+
+// rebalancers are keyed by the REBALANCE_MODE of the ideal state
+var rebalancers = map[string]rebalancer{
+	"SEMI_AUTO":  semiAutoRebalancer{},
+	"FULL_AUTO":  fullAutoRebalancer{},
+	"CUSTOMIZED": customizedRebalancer{},
+}
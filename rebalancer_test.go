@@ -0,0 +1,178 @@
+package gohelix
+
+import (
+	"testing"
+)
+
+func getTestIdealState(resource string, mode string, partitions int, replicas int) *Record {
+	is := NewRecord(resource)
+	is.SetIntField("NUM_PARTITIONS", partitions)
+	is.SetIntField("REPLICAS", replicas)
+	is.SetSimpleField("REBALANCE_MODE", mode)
+	is.SetSimpleField("STATE_MODEL_DEF_REF", StateModelMasterSlave)
+	return is
+}
+
+// countStates returns instance -> state -> number of partitions
+func countStates(bestPossible map[string]map[string]string) map[string]map[string]int {
+	result := map[string]map[string]int{}
+	for _, states := range bestPossible {
+		for instance, state := range states {
+			if result[instance] == nil {
+				result[instance] = map[string]int{}
+			}
+			result[instance][state]++
+		}
+	}
+	return result
+}
+
+func TestSemiAutoRebalancer(t *testing.T) {
+	t.Parallel()
+
+	def := getTestStateModelDef(t, StateModelMasterSlave)
+	cache := getTestClusterDataCache("a", "b", "c")
+	is := getTestIdealState("db", "SEMI_AUTO", 2, 2)
+	is.SetListField("db_0", []string{"c", "b", "a"})
+	is.SetListField("db_1", []string{"x", "a", "b", "c"})
+
+	bestPossible := semiAutoRebalancer{}.computeBestPossibleState("db", is, def, cache)
+
+	// the first instance is the master, and the replica count caps the slaves
+	if states := bestPossible["db_0"]; len(states) != 2 || states["c"] != "MASTER" || states["b"] != "SLAVE" {
+		t.Errorf("wrong best possible state of db_0: %v", states)
+	}
+
+	// instances not alive are skipped
+	if states := bestPossible["db_1"]; len(states) != 2 || states["a"] != "MASTER" || states["b"] != "SLAVE" {
+		t.Errorf("wrong best possible state of db_1: %v", states)
+	}
+}
+
+func TestFullAutoRebalancer(t *testing.T) {
+	t.Parallel()
+
+	def := getTestStateModelDef(t, StateModelMasterSlave)
+	cache := getTestClusterDataCache("a", "b", "c")
+	is := getTestIdealState("db", "FULL_AUTO", 6, 2)
+
+	bestPossible := fullAutoRebalancer{}.computeBestPossibleState("db", is, def, cache)
+	if len(bestPossible) != 6 {
+		t.Fatalf("expect 6 partitions, got %d", len(bestPossible))
+	}
+
+	for instance, counts := range countStates(bestPossible) {
+		if counts["MASTER"] != 2 || counts["SLAVE"] != 2 {
+			t.Errorf("unbalanced placement on %s: %v", instance, counts)
+		}
+	}
+
+	// a new instance only takes its share of the replicas
+	cache = getTestClusterDataCache("a", "b", "c", "d")
+	for partition, states := range bestPossible {
+		for instance, state := range states {
+			setTestCurrentState(cache, instance, "db", partition, state)
+		}
+	}
+
+	moved := 0
+	r := fullAutoRebalancer{}
+	for _, states := range r.computeBestPossibleState("db", is, def, cache) {
+		for instance, state := range states {
+			if state == "DROPPED" {
+				moved++
+			}
+
+			// the new instance joins as a slave, masters are not moved to it
+			if instance == "d" && state != "SLAVE" {
+				t.Errorf("expect SLAVE on the new instance, got %s", state)
+			}
+		}
+	}
+	if moved != 3 {
+		t.Errorf("expect 3 replicas to move to the new instance, got %d", moved)
+	}
+}
+
+func TestFullAutoRebalancerMaxPartitionsPerInstance(t *testing.T) {
+	t.Parallel()
+
+	def := getTestStateModelDef(t, StateModelMasterSlave)
+	cache := getTestClusterDataCache("a", "b", "c")
+	is := getTestIdealState("db", "FULL_AUTO", 6, 1)
+	is.SetIntField("MAX_PARTITIONS_PER_INSTANCE", 1)
+
+	placed := 0
+	for _, preferenceList := range computeFullAutoPreferenceLists("db", is, def, cache) {
+		placed += len(preferenceList)
+	}
+	if placed != 3 {
+		t.Errorf("expect 3 replicas placed, got %d", placed)
+	}
+}
+
+func TestCustomizedRebalancer(t *testing.T) {
+	t.Parallel()
+
+	def := getTestStateModelDef(t, StateModelMasterSlave)
+	cache := getTestClusterDataCache("a", "b", "c")
+	setTestCurrentState(cache, "c", "db", "db_0", "SLAVE")
+
+	is := getTestIdealState("db", "CUSTOMIZED", 1, 2)
+	is.SetMapField("db_0", "a", "MASTER")
+	is.SetMapField("db_0", "b", "SLAVE")
+	is.SetMapField("db_0", "x", "SLAVE")
+
+	states := customizedRebalancer{}.computeBestPossibleState("db", is, def, cache)["db_0"]
+	if len(states) != 3 || states["a"] != "MASTER" || states["b"] != "SLAVE" || states["c"] != "DROPPED" {
+		t.Errorf("wrong best possible state %v", states)
+	}
+
+	// the instance goes through SLAVE before becoming MASTER
+	transitions := computeTransitions("db", "db_0", states, def, cache)
+	for _, tr := range transitions {
+		if tr.instance == "a" && tr.toState != "SLAVE" {
+			t.Errorf("expect OFFLINE->SLAVE first, got %v", tr)
+		}
+		if tr.instance == "c" && tr.toState != "OFFLINE" {
+			t.Errorf("expect SLAVE->OFFLINE first, got %v", tr)
+		}
+	}
+}
+
+func TestComputeIdealStateAssignment(t *testing.T) {
+	t.Parallel()
+
+	def := getTestStateModelDef(t, StateModelMasterSlave)
+	is := getTestIdealState("db", "SEMI_AUTO", 6, 2)
+	is.SetListField("db_9", []string{"x"})
+
+	computeIdealStateAssignment(is, def, []string{"a", "b", "c"})
+
+	if len(is.ListFields) != 6 || len(is.MapFields) != 6 {
+		t.Errorf("expect 6 partitions, got %v", is.ListFields)
+	}
+
+	replicas := map[string]int{}
+	for partition := range is.ListFields {
+		preferenceList := is.GetListField(partition)
+		if len(preferenceList) != 2 {
+			t.Errorf("expect 2 replicas of %s, got %v", partition, preferenceList)
+			continue
+		}
+
+		if is.GetMapField(partition, preferenceList[0]) != "MASTER" || is.GetMapField(partition, preferenceList[1]) != "SLAVE" {
+			t.Errorf("wrong states of %s: %v", partition, is.MapFields[partition])
+		}
+		for _, instance := range preferenceList {
+			replicas[instance]++
+		}
+	}
+
+	counts := countStates(is.MapFields)
+	for _, instance := range []string{"a", "b", "c"} {
+		if replicas[instance] != 4 || counts[instance]["MASTER"] != 2 {
+			t.Errorf("unbalanced assignment on %s: %d replicas, %d masters", instance, replicas[instance], counts[instance]["MASTER"])
+		}
+	}
+}
@@ -67,6 +67,15 @@ func (r Record) GetIntField(key string, defaultValue int) int {
 	return intVal
 }
 
+// GetStringField returns the string value of a field in the SimpleField
+func (r Record) GetStringField(key string, defaultValue string) string {
+	value, ok := r.GetSimpleField(key).(string)
+	if !ok {
+		return defaultValue
+	}
+	return value
+}
+
 // SetIntField sets the integer value of a key under SimpleField.
 // the value is stored as in string form
 func (r *Record) SetIntField(key string, value int) {
@@ -133,6 +142,38 @@ func (r Record) GetMapField(key string, property string) string {
 	return r.MapFields[key][property]
 }
 
+// GetListField returns the list of values of a key under ListField
+func (r Record) GetListField(key string) []string {
+	if r.ListFields == nil {
+		return nil
+	}
+
+	switch values := r.ListFields[key].(type) {
+	case []string:
+		return values
+	case []interface{}:
+		// the form unmarshalled from json
+		result := make([]string, 0, len(values))
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+
+	return nil
+}
+
+// SetListField sets the list of values of a key under ListField
+func (r *Record) SetListField(key string, values []string) {
+	if r.ListFields == nil {
+		r.ListFields = make(map[string]interface{})
+	}
+
+	r.ListFields[key] = values
+}
+
 // NewRecordFromBytes creates a new znode instance from a byte array
 func NewRecordFromBytes(data []byte) (*Record, error) {
 	var zn Record
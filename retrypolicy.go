@@ -0,0 +1,55 @@
+package gohelix
+
+import (
+	"time"
+
+	"github.com/yichen/go-zookeeper/zk"
+)
+
+// RetryPolicy tells how the participant and the spectator retry a zookeeper operation that
+// fails, before they give up and report the error to their error callbacks.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one. Zero or less
+	// means a single attempt.
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry. It doubles after each retry, up to
+	// MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy makes 5 attempts, 50ms apart at first and up to 1s apart.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff:     50 * time.Millisecond,
+	MaxBackoff:  time.Second,
+}
+
+// do calls fn until it succeeds, fails with an error that retrying does not fix, or runs
+// out of attempts. It returns the last error.
+func (rp RetryPolicy) do(fn func() error) error {
+	backoff := rp.Backoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || !isRetriable(err) || attempt >= rp.MaxAttempts {
+			return err
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > rp.MaxBackoff {
+			backoff = rp.MaxBackoff
+		}
+	}
+}
+
+// isRetriable tells if the error may go away by itself, like a connection loss. Errors
+// about the data, like a missing node, do not.
+func isRetriable(err error) bool {
+	switch err {
+	case zk.ErrConnectionClosed, zk.ErrNoServer, zk.ErrClosing, zk.ErrSessionExpired, zk.ErrSessionMoved:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package gohelix
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yichen/go-zookeeper/zk"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+	attempts := 0
+	err := policy.do(func() error {
+		attempts++
+		if attempts < 2 {
+			return zk.ErrConnectionClosed
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("expect to succeed on the second attempt, got %v after %d", err, attempts)
+	}
+
+	attempts = 0
+	err = policy.do(func() error {
+		attempts++
+		return zk.ErrConnectionClosed
+	})
+	if err != zk.ErrConnectionClosed || attempts != 3 {
+		t.Errorf("expect to give up after 3 attempts, got %v after %d", err, attempts)
+	}
+
+	// a missing node does not show up by retrying
+	attempts = 0
+	err = policy.do(func() error {
+		attempts++
+		return zk.ErrNoNode
+	})
+	if err != zk.ErrNoNode || attempts != 1 {
+		t.Errorf("expect no retry on ErrNoNode, got %v after %d", err, attempts)
+	}
+}
@@ -0,0 +1,82 @@
+package gohelix
+
+// semiAutoRebalancer places the replicas of each partition on the instances of the
+// preference list kept in the ideal state listFields, in the order of the list.
+type semiAutoRebalancer struct{}
+
+func (r semiAutoRebalancer) computeBestPossibleState(resource string, idealState *Record, def *StateModelDefinition, cache *clusterDataCache) map[string]map[string]string {
+	result := map[string]map[string]string{}
+
+	for _, partition := range cache.partitions(resource, idealState) {
+		preferenceList := idealState.GetListField(partition)
+
+		// the whole preference list is used unless the number of replicas is set
+		replicas := cache.replicas(idealState)
+		if replicas < 1 || replicas > len(preferenceList) {
+			replicas = len(preferenceList)
+		}
+
+		result[partition] = computeStatesFromPreferenceList(resource, partition, preferenceList, replicas, def, cache)
+	}
+
+	return result
+}
+
+// computeStatesFromPreferenceList assigns the states of the state model to the live and
+// enabled instances of the preference list, in order: the highest priority state goes to
+// the first instances, as many as the state model allows, then the next state and so on.
+// A state counted as "R" takes the replicas left, so that with MasterSlave and 3 replicas
+// the first instance is the MASTER and the next two are SLAVEs.
+// Live instances holding the partition without being assigned a state are brought back
+// to the initial state if they are on the preference list, or dropped otherwise.
+func computeStatesFromPreferenceList(resource string, partition string, preferenceList []string, replicas int, def *StateModelDefinition, cache *clusterDataCache) map[string]string {
+	result := map[string]string{}
+
+	candidates := []string{}
+	for _, instance := range preferenceList {
+		if _, live := cache.liveInstances[instance]; !live || !cache.isInstanceEnabled(instance) {
+			continue
+		}
+
+		// a partition in ERROR stays there until it is reset
+		if cache.currentState(instance, resource, partition) == "ERROR" {
+			result[instance] = "ERROR"
+			continue
+		}
+
+		candidates = append(candidates, instance)
+	}
+
+	assigned := 0
+	for _, state := range def.States {
+		count := def.stateCount(state, replicas, cache.liveEnabledInstances())
+		if def.StateCounts[state] == "R" {
+			count -= assigned
+		}
+
+		for ; count > 0 && len(candidates) > 0; count-- {
+			result[candidates[0]] = state
+			candidates = candidates[1:]
+			assigned++
+		}
+	}
+
+	for instance := range cache.liveInstances {
+		if _, ok := result[instance]; ok {
+			continue
+		}
+
+		current := cache.currentState(instance, resource, partition)
+		if current == "" || current == "DROPPED" {
+			continue
+		}
+
+		if strSliceContains(preferenceList, instance) {
+			result[instance] = def.InitialState
+		} else {
+			result[instance] = "DROPPED"
+		}
+	}
+
+	return result
+}
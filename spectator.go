@@ -6,6 +6,7 @@ import (
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/yichen/go-zookeeper/zk"
 )
 
 type spectatorState uint8
@@ -65,6 +66,11 @@ type Spectator struct {
 
 	state spectatorState
 
+	// how the zookeeper operations of the spectator are retried, and who is told when
+	// they fail for good
+	retryPolicy    RetryPolicy
+	errorCallbacks []func(err error)
+
 	sync.RWMutex
 }
 
@@ -76,6 +82,7 @@ func (s *Spectator) Connect() error {
 	}
 
 	s.conn = newConnection(s.zkSvr)
+	s.conn.retryPolicy = s.retryPolicy
 	if err := s.conn.Connect(); err != nil {
 		return err
 	}
@@ -110,6 +117,26 @@ func (s *Spectator) Disconnect() {
 	s.state = spectatorDisConnected
 }
 
+// AddErrorCallback adds a callback told about the zookeeper errors the spectator cannot
+// recover from by retrying, such as a watch it fails to set. Without any, the errors are
+// logged.
+func (s *Spectator) AddErrorCallback(callback func(err error)) {
+	s.errorCallbacks = append(s.errorCallbacks, callback)
+}
+
+// SetRetryPolicy sets how the spectator retries the zookeeper operations that fail,
+// DefaultRetryPolicy by default. It takes effect on Connect.
+func (s *Spectator) SetRetryPolicy(policy RetryPolicy) {
+	s.retryPolicy = policy
+}
+
+func (s *Spectator) reportError(err error) {
+	Logger.Printf("Spectator of %s: %s\n", s.ClusterID, err.Error())
+	for _, cb := range s.errorCallbacks {
+		cb(err)
+	}
+}
+
 // IsConnected test if the spectator is connected
 func (s *Spectator) IsConnected() bool {
 	return s.state == spectatorConnected
@@ -207,9 +234,15 @@ func (s *Spectator) watchExternalViewResource(resource string) {
 			// when the update happens, unblock, and also send the resource
 			// to the channel
 			_, events, err := s.conn.GetW(s.kb.externalViewForResource(resource))
+			if err != nil {
+				// no need to watch what is gone
+				if err != zk.ErrNoNode {
+					s.reportError(err)
+				}
+				return
+			}
 			<-events
 			s.changeNotificationChan <- changeNotification{exteralViewChanged, resource}
-			must(err)
 		}
 	}()
 }
@@ -221,9 +254,15 @@ func (s *Spectator) watchIdealStateResource(resource string) {
 			// when the update happens, unblock, and also send the resource
 			// to the channel
 			_, events, err := s.conn.GetW(s.kb.idealStateForResource(resource))
+			if err != nil {
+				// no need to watch what is gone
+				if err != zk.ErrNoNode {
+					s.reportError(err)
+				}
+				return
+			}
 			<-events
 			s.changeNotificationChan <- changeNotification{idealStateChanged, resource}
-			must(err)
 		}
 	}()
 }
@@ -266,6 +305,25 @@ func (s *Spectator) GetInstanceMessages(instance string) []*Record {
 	return result
 }
 
+// GetHealthReports retrieves the health reports published by an instance
+func (s *Spectator) GetHealthReports(instance string) []*Record {
+	result := []*Record{}
+	reports, err := s.conn.Children(s.kb.healthReport(instance))
+
+	if err != nil {
+		return result
+	}
+
+	for _, name := range reports {
+		record, err := s.conn.GetRecordFromPath(s.kb.healthReportForName(instance, name))
+		if err == nil {
+			result = append(result, record)
+		}
+	}
+
+	return result
+}
+
 // GetLiveInstances retrieve a copy of the current live instances.
 func (s *Spectator) GetLiveInstances() []*Record {
 	liveInstances := []*Record{}
@@ -332,7 +390,10 @@ func (s *Spectator) GetCurrentState(instance string) []*Record {
 	result := []*Record{}
 
 	resources, err := s.conn.Children(s.kb.instance(instance))
-	must(err)
+	if err != nil {
+		s.reportError(err)
+		return result
+	}
 
 	for _, r := range resources {
 		record, err := s.conn.GetRecordFromPath(s.kb.currentStateForResource(instance, s.conn.GetSessionID(), r))
@@ -349,7 +410,10 @@ func (s *Spectator) GetInstanceConfigs() []*Record {
 	result := []*Record{}
 
 	configs, err := s.conn.Children(s.kb.participantConfigs())
-	must(err)
+	if err != nil {
+		s.reportError(err)
+		return result
+	}
 
 	for _, i := range configs {
 		record, err := s.conn.GetRecordFromPath(s.kb.participantConfig(i))
@@ -369,12 +433,18 @@ func (s *Spectator) watchCurrentStates() {
 
 func (s *Spectator) watchCurrentStateForInstance(instance string) {
 	sessions, err := s.conn.Children(s.kb.currentStates(instance))
-	must(err)
+	if err != nil {
+		s.reportError(err)
+		return
+	}
 
 	// TODO: only have one session?
 	if len(sessions) > 0 {
 		resources, err := s.conn.Children(s.kb.currentStatesForSession(instance, sessions[0]))
-		must(err)
+		if err != nil {
+			s.reportError(err)
+			return
+		}
 
 		for _, r := range resources {
 			s.watchCurrentStateOfInstanceForResource(instance, r, sessions[0])
@@ -406,7 +476,12 @@ func (s *Spectator) watchCurrentStateOfInstanceForResource(instance string, reso
 	go func() {
 		for {
 			_, events, err := s.conn.GetW(watchPath)
-			must(err)
+			if err != nil {
+				if err != zk.ErrNoNode {
+					s.reportError(err)
+				}
+				return
+			}
 			select {
 			case <-events:
 				s.changeNotificationChan <- changeNotification{currentStateChanged, instance}
@@ -420,13 +495,11 @@ func (s *Spectator) watchCurrentStateOfInstanceForResource(instance string, reso
 }
 
 func (s *Spectator) watchLiveInstances() {
-	errors := make(chan error)
-
 	go func() {
 		for {
 			_, events, err := s.conn.ChildrenW(s.kb.liveInstances())
 			if err != nil {
-				errors <- err
+				s.reportError(err)
 				return
 			}
 
@@ -436,7 +509,7 @@ func (s *Spectator) watchLiveInstances() {
 			// block the loop to wait for the live instance change
 			evt := <-events
 			if evt.Err != nil {
-				errors <- evt.Err
+				s.reportError(evt.Err)
 				return
 			}
 		}
@@ -444,13 +517,11 @@ func (s *Spectator) watchLiveInstances() {
 }
 
 func (s *Spectator) watchInstanceConfig() {
-	errors := make(chan error)
-
 	go func() {
 		for {
 			configs, events, err := s.conn.ChildrenW(s.kb.participantConfigs())
 			if err != nil {
-				errors <- err
+				s.reportError(err)
 				return
 			}
 
@@ -483,7 +554,7 @@ func (s *Spectator) watchInstanceConfig() {
 			// now need to block the loop to wait for the next update event
 			evt := <-events
 			if evt.Err != nil {
-				panic(evt.Err)
+				s.reportError(evt.Err)
 				return
 			}
 		}
@@ -497,22 +568,26 @@ func (s *Spectator) watchInstanceConfigForParticipant(instance string) {
 			// when the update happens, unblock, and also send the resource
 			// to the channel
 			_, events, err := s.conn.GetW(s.kb.participantConfig(instance))
+			if err != nil {
+				// no need to watch what is gone
+				if err != zk.ErrNoNode {
+					s.reportError(err)
+				}
+				return
+			}
 			<-events
 			s.changeNotificationChan <- changeNotification{instanceConfigChanged, instance}
-			must(err)
 		}
 	}()
 
 }
 
 func (s *Spectator) watchIdealState() {
-	errors := make(chan error)
-
 	go func() {
 		for {
 			resources, events, err := s.conn.ChildrenW(s.kb.idealStates())
 			if err != nil {
-				errors <- err
+				s.reportError(err)
 				return
 			}
 
@@ -540,7 +615,7 @@ func (s *Spectator) watchIdealState() {
 			// now need to block the loop to wait for the next update event
 			evt := <-events
 			if evt.Err != nil {
-				panic(evt.Err)
+				s.reportError(evt.Err)
 				return
 			}
 		}
@@ -548,13 +623,11 @@ func (s *Spectator) watchIdealState() {
 }
 
 func (s *Spectator) watchExternalView() {
-	errors := make(chan error)
-
 	go func() {
 		for {
 			resources, events, err := s.conn.ChildrenW(s.kb.externalView())
 			if err != nil {
-				errors <- err
+				s.reportError(err)
 				return
 			}
 
@@ -582,8 +655,7 @@ func (s *Spectator) watchExternalView() {
 			// now need to block the loop to wait for the next update event
 			evt := <-events
 			if evt.Err != nil {
-				//panic(evt.Err)
-				fmt.Println(evt.Err)
+				s.reportError(evt.Err)
 				return
 			}
 		}
@@ -596,7 +668,8 @@ func (s *Spectator) watchControllerMessages() {
 	go func() {
 		_, events, err := s.conn.ChildrenW(s.kb.controllerMessages())
 		if err != nil {
-			panic(err)
+			s.reportError(err)
+			return
 		}
 
 		// send the INIT update
@@ -611,7 +684,8 @@ func (s *Spectator) watchInstanceMessages(instance string) {
 	go func() {
 		messages, events, err := s.conn.ChildrenW(s.kb.messages(instance))
 		if err != nil {
-			panic(err)
+			s.reportError(err)
+			return
 		}
 
 		for _, m := range messages {
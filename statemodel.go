@@ -1,5 +1,11 @@
 package gohelix
 
+import (
+	"context"
+	"strings"
+	"time"
+)
+
 // Transition associates a handler function with the state transition from the from state
 // to the to state.
 type Transition struct {
@@ -8,14 +14,78 @@ type Transition struct {
 	Handler   func(string)
 }
 
+// TransitionContext describes the state transition message a handler is invoked for.
+// The embedded context is done when the transition times out or is cancelled, and a long
+// running handler should give up then: the transition, and the next ones of the partition,
+// wait for the handler to return.
+type TransitionContext struct {
+	context.Context
+
+	MessageID  string
+	Resource   string
+	Partition  string
+	FromState  string
+	ToState    string
+	StateModel string
+}
+
+// TransitionHandler handles a state transition of a partition. When it returns an error,
+// the partition goes to the ERROR state, and stays there until it is reset.
+type TransitionHandler func(ctx *TransitionContext) error
+
+// TransitionInterceptor is called around every state transition of the participant, with
+// the message of the transition, for logging, metrics, tracing, authorization or rate
+// limiting. It runs the transition by calling next, and can wait before, as long as the ctx
+// is not done. Returning ErrTransitionVetoed without calling next leaves the partition in
+// its from state, while any other error sends it to ERROR.
+type TransitionInterceptor func(ctx *TransitionContext, message *Record, next TransitionHandler) error
+
+// interceptTransition chains the interceptors around the handler, the first one outermost.
+func interceptTransition(interceptors []TransitionInterceptor, message *Record, handler TransitionHandler) TransitionHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx *TransitionContext) error {
+			return interceptor(ctx, message, next)
+		}
+	}
+	return handler
+}
+
+// StateModelFactory creates a state model for each partition of the resources whose
+// messages carry its STATE_MODEL_FACTORY_NAME, so that the handlers of a partition can hold
+// its own resources, like open files. The state model of a partition lives until the
+// partition goes to DROPPED.
+type StateModelFactory interface {
+	CreateStateModel(resource string, partition string) StateModel
+}
+
+// StateModelFactoryFunc adapts a function to a StateModelFactory
+type StateModelFactoryFunc func(resource string, partition string) StateModel
+
+// CreateStateModel calls f(resource, partition)
+func (f StateModelFactoryFunc) CreateStateModel(resource string, partition string) StateModel {
+	return f(resource, partition)
+}
+
+// transition is a registered state transition and its handler
+type transition struct {
+	fromState string
+	toState   string
+	handler   TransitionHandler
+}
+
 // StateModel is a collection of state transitions and their handlers
 type StateModel struct {
-	transitions []Transition
+	transitions []transition
 }
 
 // NewStateModel creates an empty state model
 func NewStateModel(transitions []Transition) StateModel {
-	return StateModel{transitions}
+	sm := StateModel{}
+	for _, t := range transitions {
+		sm.AddTransition(t.FromState, t.ToState, t.Handler)
+	}
+	return sm
 }
 
 // Size is the number of transitions in the state model
@@ -25,7 +95,80 @@ func (sm *StateModel) Size() int {
 
 // AddTransition add a state transition handler to the state model
 func (sm *StateModel) AddTransition(fromState string, toState string, handler func(string)) {
-	transition := Transition{fromState, toState, handler}
-	// TODO validate
-	sm.transitions = append(sm.transitions, transition)
+	sm.AddTransitionHandler(fromState, toState, func(ctx *TransitionContext) error {
+		if handler != nil {
+			handler(ctx.Partition)
+		}
+		return nil
+	})
+}
+
+// AddTransitionHandler adds a state transition handler that can fail to the state model.
+// The state model is validated against its definition in the cluster when the participant
+// connects.
+func (sm *StateModel) AddTransitionHandler(fromState string, toState string, handler TransitionHandler) {
+	sm.transitions = append(sm.transitions, transition{fromState, toState, handler})
+}
+
+// handler returns the handler of the transition from the fromState to the toState, nil
+// if the state model has no such transition.
+func (sm *StateModel) handler(fromState string, toState string) TransitionHandler {
+	for _, t := range sm.transitions {
+		if strings.EqualFold(t.fromState, fromState) && strings.EqualFold(t.toState, toState) {
+			return t.handler
+		}
+	}
+
+	return nil
+}
+
+// runTransitionHandler runs the handler, within the timeout if positive, and retries it up
+// to retries times while it fails. It gives up on ErrTransitionCancelled once the ctx is
+// cancelled, and on ErrTransitionTimeout once the last attempt times out. An attempt that
+// times out or is cancelled is over only when the handler returns, so that no two attempts
+// of the transition, nor the next transition of the partition, run at the same time.
+func runTransitionHandler(ctx context.Context, handler TransitionHandler, tctx TransitionContext, timeout time.Duration, retries int) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if ctx.Err() != nil {
+			return ErrTransitionCancelled
+		}
+
+		if attempt > 0 {
+			Logger.Printf("Retrying transition of %s from %s to %s, attempt %d: %s\n", tctx.Partition, tctx.FromState, tctx.ToState, attempt, err.Error())
+		}
+
+		if err = runTransitionHandlerOnce(ctx, handler, tctx, timeout); err == nil || err == ErrTransitionCancelled {
+			return err
+		}
+	}
+
+	return err
+}
+
+func runTransitionHandlerOnce(ctx context.Context, handler TransitionHandler, tctx TransitionContext, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	tctx.Context = ctx
+
+	done := make(chan error, 1)
+	go func() {
+		done <- handler(&tctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// the handler may still be working on the partition, however long it takes to notice
+	<-done
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTransitionTimeout
+	}
+	return ErrTransitionCancelled
 }
@@ -1,7 +1,12 @@
 package gohelix
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNewStateModel(t *testing.T) {
@@ -29,3 +34,165 @@ func TestNewStateModel(t *testing.T) {
 		t.Error("The StateModel.Size() should reeturn 2")
 	}
 }
+
+func TestStateModelHandler(t *testing.T) {
+	t.Parallel()
+
+	called := ""
+	sm := NewStateModel([]Transition{
+		{"OFFLINE", "ONLINE", func(partition string) { called = "OFFLINE-ONLINE " + partition }},
+	})
+	sm.AddTransition("ONLINE", "OFFLINE", func(partition string) { called = "ONLINE-OFFLINE " + partition })
+
+	handler := sm.handler("OFFLINE", "ONLINE")
+	if handler == nil {
+		t.Fatal("expect the OFFLINE-ONLINE handler")
+	}
+	if err := handler(&TransitionContext{Partition: "db_0"}); err != nil {
+		t.Error(err)
+	}
+	if called != "OFFLINE-ONLINE db_0" {
+		t.Errorf("wrong handler called: %s", called)
+	}
+
+	if sm.handler("ONLINE", "OFFLINE") == nil {
+		t.Error("expect the ONLINE-OFFLINE handler")
+	}
+
+	if sm.handler("OFFLINE", "DROPPED") != nil {
+		t.Error("expect no OFFLINE-DROPPED handler")
+	}
+}
+
+func TestStateModelTransitionHandler(t *testing.T) {
+	t.Parallel()
+
+	sm := NewStateModel(nil)
+	sm.AddTransitionHandler("OFFLINE", "ONLINE", func(ctx *TransitionContext) error {
+		return fmt.Errorf("failed to bootstrap %s of %s", ctx.Partition, ctx.Resource)
+	})
+
+	handler := sm.handler("OFFLINE", "ONLINE")
+	if handler == nil {
+		t.Fatal("expect the OFFLINE-ONLINE handler")
+	}
+
+	err := handler(&TransitionContext{Resource: "db", Partition: "db_0", FromState: "OFFLINE", ToState: "ONLINE"})
+	if err == nil || err.Error() != "failed to bootstrap db_0 of db" {
+		t.Errorf("expect the error of the handler, got %v", err)
+	}
+}
+
+func TestRunTransitionHandler(t *testing.T) {
+	t.Parallel()
+
+	tctx := TransitionContext{Resource: "db", Partition: "db_0", FromState: "OFFLINE", ToState: "ONLINE"}
+
+	// succeeds on the third attempt
+	attempts := 0
+	flaky := func(ctx *TransitionContext) error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("attempt %d failed", attempts)
+		}
+		return nil
+	}
+	if err := runTransitionHandler(context.Background(), flaky, tctx, 0, 2); err != nil || attempts != 3 {
+		t.Errorf("expect success after 3 attempts, got %v after %d", err, attempts)
+	}
+
+	// gives up after the retries
+	attempts = 0
+	if err := runTransitionHandler(context.Background(), flaky, tctx, 0, 1); err == nil || attempts != 2 {
+		t.Errorf("expect failure after 2 attempts, got %v after %d", err, attempts)
+	}
+
+	// times out
+	slow := func(ctx *TransitionContext) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err := runTransitionHandler(context.Background(), slow, tctx, 10*time.Millisecond, 1); err != ErrTransitionTimeout {
+		t.Errorf("expect ErrTransitionTimeout, got %v", err)
+	}
+
+	// cancelled while running
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if err := runTransitionHandler(ctx, slow, tctx, time.Minute, 3); err != ErrTransitionCancelled {
+		t.Errorf("expect ErrTransitionCancelled, got %v", err)
+	}
+
+	// cancelled before it starts
+	if err := runTransitionHandler(ctx, flaky, tctx, 0, 0); err != ErrTransitionCancelled {
+		t.Errorf("expect ErrTransitionCancelled, got %v", err)
+	}
+
+	// a handler ignoring the timeout is not retried, nor left behind, while it runs
+	var running, maxRunning int32
+	stubborn := func(ctx *TransitionContext) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+	if err := runTransitionHandler(context.Background(), stubborn, tctx, 10*time.Millisecond, 3); err != ErrTransitionTimeout {
+		t.Errorf("expect ErrTransitionTimeout, got %v", err)
+	}
+	if atomic.LoadInt32(&running) != 0 || atomic.LoadInt32(&maxRunning) != 1 {
+		t.Errorf("expect one attempt at a time, and none left running, got %d running, %d at most", running, maxRunning)
+	}
+}
+
+func TestInterceptTransition(t *testing.T) {
+	t.Parallel()
+
+	message := NewRecord("msg")
+	message.SetSimpleField("RESOURCE_NAME", "db")
+
+	order := []string{}
+	logging := func(ctx *TransitionContext, message *Record, next TransitionHandler) error {
+		order = append(order, "logging")
+		err := next(ctx)
+		order = append(order, "logged")
+		return err
+	}
+	authorization := func(ctx *TransitionContext, message *Record, next TransitionHandler) error {
+		if message.GetStringField("RESOURCE_NAME", "") != "db" {
+			return ErrTransitionVetoed
+		}
+		order = append(order, "authorized")
+		return next(ctx)
+	}
+	handler := func(ctx *TransitionContext) error {
+		order = append(order, "handler")
+		return nil
+	}
+
+	run := interceptTransition([]TransitionInterceptor{logging, authorization}, message, handler)
+	if err := run(&TransitionContext{Context: context.Background()}); err != nil {
+		t.Error(err)
+	}
+	if strings.Join(order, ",") != "logging,authorized,handler,logged" {
+		t.Errorf("expect the interceptors around the handler in order, got %v", order)
+	}
+
+	// vetoed, the handler does not run
+	order = []string{}
+	message.SetSimpleField("RESOURCE_NAME", "other")
+	if err := run(&TransitionContext{Context: context.Background()}); err != ErrTransitionVetoed {
+		t.Errorf("expect ErrTransitionVetoed, got %v", err)
+	}
+	if strings.Join(order, ",") != "logging,logged" {
+		t.Errorf("expect the handler not to run, got %v", order)
+	}
+}
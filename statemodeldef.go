@@ -0,0 +1,455 @@
+package gohelix
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StateModelDefinition defines a state model, as stored under /{cluster}/STATEMODELDEFS:
+// its states from the highest priority to the lowest, the state partitions start in, how
+// many replicas of a partition each state takes, and the transitions allowed between the
+// states, from the highest priority to the lowest. Build one with a
+// StateModelDefinitionBuilder.
+type StateModelDefinition struct {
+	Name         string
+	InitialState string
+	States       []string
+
+	// count constraint of each state: a number, "R" for the number of replicas or "N" for
+	// the number of live instances. States without one, like OFFLINE, are not bounded.
+	StateCounts map[string]string
+
+	Transitions []StateModelTransition
+
+	// from state -> to state -> next hop, computed once when the definition is read or
+	// built: from the {STATE}.next map fields of its record if any, along the shortest
+	// paths of the transitions otherwise
+	nextHops map[string]map[string]string
+}
+
+// StateModelTransition is a transition allowed by a state model definition
+type StateModelTransition struct {
+	FromState string
+	ToState   string
+}
+
+// String returns the transition as FROM-TO
+func (t StateModelTransition) String() string {
+	return t.FromState + "-" + t.ToState
+}
+
+// StateModelDefinitionBuilder builds a StateModelDefinition. For example, with states in
+// the order of their priority:
+//
+//	def, err := NewStateModelDefinitionBuilder("Bootstrap").
+//		AddState("SERVING", "1").
+//		AddState("ONLINE", "R").
+//		AddState("BOOTSTRAP", "").
+//		AddState("OFFLINE", "").
+//		AddState("DROPPED", "").
+//		InitialState("OFFLINE").
+//		AddTransition("OFFLINE", "BOOTSTRAP").
+//		AddTransition("BOOTSTRAP", "ONLINE").
+//		AddTransition("ONLINE", "SERVING").
+//		AddTransition("SERVING", "ONLINE").
+//		AddTransition("ONLINE", "OFFLINE").
+//		AddTransition("OFFLINE", "DROPPED").
+//		Build()
+type StateModelDefinitionBuilder struct {
+	def StateModelDefinition
+}
+
+// NewStateModelDefinitionBuilder starts the definition of the named state model
+func NewStateModelDefinitionBuilder(name string) *StateModelDefinitionBuilder {
+	return &StateModelDefinitionBuilder{
+		def: StateModelDefinition{
+			Name:        name,
+			StateCounts: map[string]string{},
+		},
+	}
+}
+
+// AddState adds a state, with a lower priority than the states added before. The count is
+// a number, "R", "N", or empty if the state is not bounded.
+func (b *StateModelDefinitionBuilder) AddState(state string, count string) *StateModelDefinitionBuilder {
+	b.def.States = append(b.def.States, state)
+	if count != "" {
+		b.def.StateCounts[state] = count
+	}
+	return b
+}
+
+// InitialState sets the state the partitions start in
+func (b *StateModelDefinitionBuilder) InitialState(state string) *StateModelDefinitionBuilder {
+	b.def.InitialState = state
+	return b
+}
+
+// AddTransition allows the transition, with a lower priority than the transitions added
+// before
+func (b *StateModelDefinitionBuilder) AddTransition(fromState string, toState string) *StateModelDefinitionBuilder {
+	b.def.Transitions = append(b.def.Transitions, StateModelTransition{fromState, toState})
+	return b
+}
+
+// Build returns the definition, or an error telling what is wrong with it
+func (b *StateModelDefinitionBuilder) Build() (*StateModelDefinition, error) {
+	def := b.def
+	def.States = append([]string{}, b.def.States...)
+	def.Transitions = append([]StateModelTransition{}, b.def.Transitions...)
+	def.StateCounts = map[string]string{}
+	for state, count := range b.def.StateCounts {
+		def.StateCounts[state] = count
+	}
+
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+	def.nextHops = def.shortestPaths()
+	return &def, nil
+}
+
+// Validate checks the definition has a name, distinct states, an initial state among them,
+// valid counts, and transitions between its states only.
+func (def *StateModelDefinition) Validate() error {
+	if def.Name == "" {
+		return fmt.Errorf("%w: no name", ErrInvalidStateModelDef)
+	}
+
+	states := map[string]bool{}
+	for _, state := range def.States {
+		if state == "" || strings.Contains(state, "-") {
+			return fmt.Errorf("%w: %s has an invalid state %q", ErrInvalidStateModelDef, def.Name, state)
+		}
+		if states[state] {
+			return fmt.Errorf("%w: %s has state %s twice", ErrInvalidStateModelDef, def.Name, state)
+		}
+		states[state] = true
+	}
+
+	if !states[def.InitialState] {
+		return fmt.Errorf("%w: initial state %q of %s is not one of its states", ErrInvalidStateModelDef, def.InitialState, def.Name)
+	}
+
+	for state, count := range def.StateCounts {
+		if !states[state] {
+			return fmt.Errorf("%w: %s has a count for unknown state %s", ErrInvalidStateModelDef, def.Name, state)
+		}
+		if n, err := strconv.Atoi(count); count != "R" && count != "N" && (err != nil || n < -1) {
+			return fmt.Errorf("%w: count %q of state %s of %s is not a number, R or N", ErrInvalidStateModelDef, count, state, def.Name)
+		}
+	}
+
+	for _, t := range def.Transitions {
+		if !states[t.FromState] || !states[t.ToState] || t.FromState == t.ToState {
+			return fmt.Errorf("%w: transition %s of %s is not between two of its states", ErrInvalidStateModelDef, t, def.Name)
+		}
+	}
+
+	return nil
+}
+
+// statePriority returns the position of the state in the states of the definition, the
+// lower the higher the priority. Unknown states come last.
+func (def *StateModelDefinition) statePriority(state string) int {
+	for i, s := range def.States {
+		if s == state {
+			return i
+		}
+	}
+	return len(def.States)
+}
+
+// stateCount resolves the count constraint of the state for a partition with the
+// given number of replicas and live instances. It returns -1 if the state is not
+// assigned by count, like OFFLINE or DROPPED.
+func (def *StateModelDefinition) stateCount(state string, replicas int, liveInstances int) int {
+	switch count := def.StateCounts[state]; count {
+	case "N":
+		return liveInstances
+	case "R":
+		return replicas
+	default:
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+}
+
+// upperBound returns the fixed number of instances allowed in the state, like 1 for
+// MASTER. It returns -1 if the state is not bounded by a fixed number.
+func (def *StateModelDefinition) upperBound(state string) int {
+	n, err := strconv.Atoi(def.StateCounts[state])
+	if err != nil || n < 1 {
+		return -1
+	}
+	return n
+}
+
+// validateStateModel checks the state model registered by a participant against the
+// definition: every transition of the definition has a handler, the handlers only use
+// states of the definition, and the initial state can be reached back from every state the
+// handlers enter, so that a partition can always be taken offline. ERROR and DROPPED are
+// always valid states, and the ERROR transitions need no handler.
+func (def *StateModelDefinition) validateStateModel(sm *StateModel) error {
+	if !strSliceContains(def.States, def.InitialState) {
+		return fmt.Errorf("%w: initial state %s of %s is not in its states", ErrInvalidStateModel, def.InitialState, def.Name)
+	}
+
+	for _, t := range def.Transitions {
+		if sm.handler(t.FromState, t.ToState) == nil && !strings.EqualFold(t.FromState, "ERROR") {
+			return fmt.Errorf("%w: no handler for transition %s of %s", ErrInvalidStateModel, t, def.Name)
+		}
+	}
+
+	valid := func(state string) bool {
+		for _, s := range append([]string{"ERROR", "DROPPED"}, def.States...) {
+			if strings.EqualFold(s, state) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, t := range sm.transitions {
+		for _, state := range []string{t.fromState, t.toState} {
+			if !valid(state) {
+				return fmt.Errorf("%w: state %s of transition %s-%s is not in %s", ErrInvalidStateModel, state, t.fromState, t.toState, def.Name)
+			}
+		}
+	}
+
+	// the states from which the handlers lead back to the initial state
+	reaching := map[string]bool{strings.ToUpper(def.InitialState): true}
+	for found := true; found; {
+		found = false
+		for _, t := range sm.transitions {
+			from := strings.ToUpper(t.fromState)
+			if reaching[strings.ToUpper(t.toState)] && !reaching[from] {
+				reaching[from] = true
+				found = true
+			}
+		}
+	}
+
+	for _, t := range sm.transitions {
+		to := strings.ToUpper(t.toState)
+		if to == "ERROR" || to == "DROPPED" {
+			continue
+		}
+		if !reaching[to] {
+			return fmt.Errorf("%w: initial state %s of %s cannot be reached from %s", ErrInvalidStateModel, def.InitialState, def.Name, t.toState)
+		}
+	}
+
+	return nil
+}
+
+// nextStates returns, for each state, the next hop toward every state reachable from it.
+// The definitions not read nor built, but set up field by field, have their table computed
+// on each call.
+func (def *StateModelDefinition) nextStates() map[string]map[string]string {
+	if def.nextHops != nil {
+		return def.nextHops
+	}
+	return def.shortestPaths()
+}
+
+// shortestPaths returns, for each state, the next hop toward every state reachable from it,
+// along the shortest path of transitions. Paths of equal length go through the transition
+// of the highest priority.
+func (def *StateModelDefinition) shortestPaths() map[string]map[string]string {
+	result := map[string]map[string]string{}
+
+	for _, from := range def.States {
+		next := map[string]string{}
+		visited := map[string]bool{from: true}
+
+		// breadth first, so that the first path found to a state is the shortest
+		queue := []string{from}
+		for len(queue) > 0 {
+			state := queue[0]
+			queue = queue[1:]
+
+			for _, t := range def.Transitions {
+				if t.FromState != state || visited[t.ToState] {
+					continue
+				}
+				visited[t.ToState] = true
+
+				if state == from {
+					next[t.ToState] = t.ToState
+				} else {
+					next[t.ToState] = next[state]
+				}
+				queue = append(queue, t.ToState)
+			}
+		}
+
+		if len(next) > 0 {
+			result[from] = next
+		}
+	}
+
+	result["ERROR"] = def.errorNextStates()
+
+	return result
+}
+
+// errorNextStates returns the next hops from ERROR: a partition in ERROR can always be reset
+// to the initial state, or dropped.
+func (def *StateModelDefinition) errorNextStates() map[string]string {
+	next := map[string]string{def.InitialState: def.InitialState}
+	if strSliceContains(def.States, "DROPPED") {
+		next["DROPPED"] = "DROPPED"
+	}
+	return next
+}
+
+// NextState returns the next hop from the fromState toward the toState, e.g. SLAVE from
+// OFFLINE toward MASTER, as the {STATE}.next map fields of the definition say, or along the
+// shortest path of transitions without them. It returns empty if the toState cannot be
+// reached, or is the fromState and the {STATE}.next map fields do not say otherwise.
+func (def *StateModelDefinition) NextState(fromState string, toState string) string {
+	return def.nextStates()[fromState][toState]
+}
+
+// Path returns the states a partition goes through from the fromState to the toState, hop
+// by hop as NextState says, e.g. [SLAVE MASTER] from OFFLINE to MASTER. It returns nil if the
+// toState cannot be reached, and an empty path if it is the fromState.
+func (def *StateModelDefinition) Path(fromState string, toState string) []string {
+	if fromState == toState {
+		return []string{}
+	}
+
+	nextStates := def.nextStates()
+	if nextStates[fromState][toState] == "" {
+		return nil
+	}
+
+	path := []string{}
+	for state := fromState; state != toState; {
+		state = nextStates[state][toState]
+
+		// {STATE}.next map fields with a gap or a loop lead nowhere
+		if state == "" || len(path) > len(def.States) {
+			return nil
+		}
+		path = append(path, state)
+	}
+	return path
+}
+
+// UnreachableStates returns the states a partition can never enter from the initial state
+// through the transitions of the definition, in the order of their priority. ERROR is left
+// out, as partitions enter it when a transition fails.
+func (def *StateModelDefinition) UnreachableStates() []string {
+	reachable := def.shortestPaths()[def.InitialState]
+
+	result := []string{}
+	for _, state := range def.States {
+		if _, ok := reachable[state]; !ok && state != def.InitialState && state != "ERROR" {
+			result = append(result, state)
+		}
+	}
+	return result
+}
+
+// AllowsTransition tells if the transition from the fromState to the toState is a single
+// hop of the definition. A partition in ERROR may always go to the initial state, or to
+// DROPPED.
+func (def *StateModelDefinition) AllowsTransition(fromState string, toState string) bool {
+	for _, t := range def.Transitions {
+		if strings.EqualFold(t.FromState, fromState) && strings.EqualFold(t.ToState, toState) {
+			return true
+		}
+	}
+
+	return strings.EqualFold(fromState, "ERROR") &&
+		(strings.EqualFold(toState, def.InitialState) || strings.EqualFold(toState, "DROPPED"))
+}
+
+// Record returns the definition in the form stored in zookeeper, with the next hop from
+// each state toward the others in the {STATE}.next map fields.
+func (def *StateModelDefinition) Record() *Record {
+	r := NewRecord(def.Name)
+	r.SetSimpleField("INITIAL_STATE", def.InitialState)
+	r.SetListField("STATE_PRIORITY_LIST", def.States)
+
+	transitions := []string{}
+	for _, t := range def.Transitions {
+		transitions = append(transitions, t.String())
+	}
+	r.SetListField("STATE_TRANSITION_PRIORITYLIST", transitions)
+
+	for _, state := range def.States {
+		count, ok := def.StateCounts[state]
+		if !ok {
+			count = "-1"
+		}
+		r.SetMapField(state+".meta", "count", count)
+	}
+
+	for state, next := range def.nextStates() {
+		for to, hop := range next {
+			r.SetMapField(state+".next", to, hop)
+		}
+	}
+
+	return r
+}
+
+// NewStateModelDefinitionFromRecord reads the definition from its form stored in zookeeper.
+// The next hops between the states come from its {STATE}.next map fields, or from its
+// transitions when it has none.
+func NewStateModelDefinitionFromRecord(r *Record) (*StateModelDefinition, error) {
+	def := &StateModelDefinition{
+		Name:         r.ID,
+		InitialState: r.GetStringField("INITIAL_STATE", ""),
+		States:       r.GetListField("STATE_PRIORITY_LIST"),
+		StateCounts:  map[string]string{},
+	}
+
+	nextHops := map[string]map[string]string{}
+	for key, fields := range r.MapFields {
+		switch {
+		case strings.HasSuffix(key, ".meta"):
+			if count := fields["count"]; count != "" && count != "-1" {
+				def.StateCounts[strings.TrimSuffix(key, ".meta")] = count
+			}
+		case strings.HasSuffix(key, ".next"):
+			next := map[string]string{}
+			for to, hop := range fields {
+				next[to] = hop
+			}
+			nextHops[strings.TrimSuffix(key, ".next")] = next
+		}
+	}
+
+	for _, t := range r.GetListField("STATE_TRANSITION_PRIORITYLIST") {
+		states := strings.SplitN(t, "-", 2)
+		if len(states) != 2 {
+			return nil, fmt.Errorf("%w: transition %s of %s is malformed", ErrInvalidStateModelDef, t, def.Name)
+		}
+		def.Transitions = append(def.Transitions, StateModelTransition{states[0], states[1]})
+	}
+
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+
+	// the next hops written with the definition win over the ones of the transitions, like
+	// OFFLINE toward DROPPED in STORAGE_DEFAULT_SM_SCHEMATA, which has no OFFLINE-DROPPED
+	if len(nextHops) == 0 {
+		def.nextHops = def.shortestPaths()
+	} else {
+		if _, ok := nextHops["ERROR"]; !ok {
+			nextHops["ERROR"] = def.errorNextStates()
+		}
+		def.nextHops = nextHops
+	}
+	return def, nil
+}
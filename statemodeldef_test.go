@@ -0,0 +1,281 @@
+package gohelix
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func getTestStateModelDef(t *testing.T, name string) *StateModelDefinition {
+	r, err := NewRecordFromBytes([]byte(HelixDefaultNodes[name]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def, err := NewStateModelDefinitionFromRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return def
+}
+
+func TestNewStateModelDefinition(t *testing.T) {
+	t.Parallel()
+
+	def := getTestStateModelDef(t, StateModelMasterSlave)
+
+	if def.Name != "MasterSlave" || def.InitialState != "OFFLINE" {
+		t.Error("wrong name or initial state")
+	}
+
+	if len(def.States) != 5 || def.States[0] != "MASTER" {
+		t.Error("wrong state priority list")
+	}
+
+	if def.NextState("OFFLINE", "MASTER") != "SLAVE" {
+		t.Error("OFFLINE->MASTER should go through SLAVE")
+	}
+
+	if def.NextState("OFFLINE", "ERROR") != "" {
+		t.Error("OFFLINE->ERROR should not be reachable")
+	}
+
+	if def.stateCount("MASTER", 3, 5) != 1 || def.stateCount("SLAVE", 3, 5) != 3 || def.stateCount("OFFLINE", 3, 5) != -1 {
+		t.Error("wrong state count")
+	}
+
+	if def.upperBound("MASTER") != 1 || def.upperBound("SLAVE") != -1 {
+		t.Error("wrong upper bound")
+	}
+}
+
+func TestValidateStateModel(t *testing.T) {
+	t.Parallel()
+
+	def := getTestStateModelDef(t, StateModelOnlineOffline)
+
+	sm := NewStateModel([]Transition{
+		{"OFFLINE", "ONLINE", nil},
+		{"ONLINE", "OFFLINE", nil},
+		{"OFFLINE", "DROPPED", nil},
+	})
+	if err := def.validateStateModel(&sm); err != nil {
+		t.Error(err)
+	}
+
+	// a transition of the definition without handler
+	sm = NewStateModel([]Transition{
+		{"OFFLINE", "ONLINE", nil},
+		{"ONLINE", "OFFLINE", nil},
+	})
+	if err := def.validateStateModel(&sm); !errors.Is(err, ErrInvalidStateModel) || !strings.Contains(err.Error(), "OFFLINE-DROPPED") {
+		t.Errorf("expect the missing OFFLINE-DROPPED handler, got %v", err)
+	}
+
+	// a state not in the definition
+	sm.AddTransition("OFFLINE", "DROPPED", nil)
+	sm.AddTransition("ONLINE", "MASTER", nil)
+	if err := def.validateStateModel(&sm); !errors.Is(err, ErrInvalidStateModel) || !strings.Contains(err.Error(), "MASTER") {
+		t.Errorf("expect MASTER not in the definition, got %v", err)
+	}
+
+	// no way back to OFFLINE once ONLINE
+	sm = NewStateModel([]Transition{
+		{"OFFLINE", "ONLINE", nil},
+		{"OFFLINE", "DROPPED", nil},
+	})
+	def.Transitions = []StateModelTransition{{"OFFLINE", "ONLINE"}, {"OFFLINE", "DROPPED"}}
+	if err := def.validateStateModel(&sm); !errors.Is(err, ErrInvalidStateModel) || !strings.Contains(err.Error(), "cannot be reached from ONLINE") {
+		t.Errorf("expect OFFLINE unreachable from ONLINE, got %v", err)
+	}
+}
+
+func TestStateModelDefinitionRecord(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{StateModelLeaderStandby, StateModelMasterSlave, StateModelOnlineOffline,
+		"STORAGE_DEFAULT_SM_SCHEMATA", StateModelSchedulerTaskQueue, StateModelTask} {
+		r, err := NewRecordFromBytes([]byte(HelixDefaultNodes[name]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		def, err := NewStateModelDefinitionFromRecord(r)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		again, err := NewStateModelDefinitionFromRecord(def.Record())
+		if err != nil || !reflect.DeepEqual(def, again) {
+			t.Errorf("%s: expect the same definition from its record, got %v %v", name, again, err)
+		}
+	}
+
+	// the next hops computed from the transitions match the ones of the default definition
+	r, _ := NewRecordFromBytes([]byte(HelixDefaultNodes[StateModelMasterSlave]))
+	stripped, _ := NewRecordFromBytes([]byte(HelixDefaultNodes[StateModelMasterSlave]))
+	for _, state := range []string{"MASTER", "SLAVE", "OFFLINE", "ERROR"} {
+		stripped.RemoveMapField(state + ".next")
+	}
+	def, _ := NewStateModelDefinitionFromRecord(stripped)
+	record := def.Record()
+	for _, state := range []string{"MASTER", "SLAVE", "OFFLINE", "ERROR"} {
+		if !reflect.DeepEqual(record.MapFields[state+".next"], r.MapFields[state+".next"]) {
+			t.Errorf("expect %s.next %v, got %v", state, r.MapFields[state+".next"], record.MapFields[state+".next"])
+		}
+	}
+	if parsed, err := NewStateModelDefinitionFromRecord(record); err != nil || parsed.NextState("OFFLINE", "MASTER") != "SLAVE" || parsed.stateCount("SLAVE", 3, 5) != 3 {
+		t.Error("expect the record usable by the controller")
+	}
+}
+
+func TestStateModelDefinitionBuilder(t *testing.T) {
+	t.Parallel()
+
+	def, err := NewStateModelDefinitionBuilder("Bootstrap").
+		AddState("SERVING", "1").
+		AddState("ONLINE", "R").
+		AddState("BOOTSTRAP", "").
+		AddState("OFFLINE", "").
+		AddState("DROPPED", "").
+		InitialState("OFFLINE").
+		AddTransition("OFFLINE", "BOOTSTRAP").
+		AddTransition("BOOTSTRAP", "ONLINE").
+		AddTransition("ONLINE", "SERVING").
+		AddTransition("SERVING", "ONLINE").
+		AddTransition("ONLINE", "OFFLINE").
+		AddTransition("OFFLINE", "DROPPED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := NewStateModelDefinitionFromRecord(def.Record())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.NextState("OFFLINE", "SERVING") != "BOOTSTRAP" || parsed.NextState("SERVING", "DROPPED") != "ONLINE" ||
+		parsed.NextState("BOOTSTRAP", "OFFLINE") != "ONLINE" || parsed.NextState("ERROR", "OFFLINE") != "OFFLINE" {
+		t.Errorf("wrong next states %v", parsed.nextStates())
+	}
+	if parsed.upperBound("SERVING") != 1 || parsed.stateCount("ONLINE", 3, 5) != 3 || parsed.stateCount("OFFLINE", 3, 5) != -1 {
+		t.Errorf("wrong state counts %v", parsed.StateCounts)
+	}
+
+	invalid := []*StateModelDefinitionBuilder{
+		NewStateModelDefinitionBuilder("").AddState("OFFLINE", "").InitialState("OFFLINE"),
+		NewStateModelDefinitionBuilder("x").AddState("OFFLINE", "").InitialState("ONLINE"),
+		NewStateModelDefinitionBuilder("x").AddState("OFFLINE", "").AddState("OFFLINE", "").InitialState("OFFLINE"),
+		NewStateModelDefinitionBuilder("x").AddState("OFFLINE", "").AddState("ONLINE", "many").InitialState("OFFLINE"),
+		NewStateModelDefinitionBuilder("x").AddState("OFFLINE", "").InitialState("OFFLINE").AddTransition("OFFLINE", "ONLINE"),
+	}
+	for i, b := range invalid {
+		if _, err := b.Build(); !errors.Is(err, ErrInvalidStateModelDef) {
+			t.Errorf("expect definition %d invalid, got %v", i, err)
+		}
+	}
+}
+
+func TestStateModelDefinitionPath(t *testing.T) {
+	t.Parallel()
+
+	r, _ := NewRecordFromBytes([]byte(HelixDefaultNodes[StateModelMasterSlave]))
+	def, err := NewStateModelDefinitionFromRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if def.NextState("OFFLINE", "MASTER") != "SLAVE" || def.NextState("MASTER", "DROPPED") != "SLAVE" || def.NextState("OFFLINE", "OFFLINE") != "" {
+		t.Error("wrong next state")
+	}
+
+	if path := def.Path("OFFLINE", "MASTER"); !reflect.DeepEqual(path, []string{"SLAVE", "MASTER"}) {
+		t.Errorf("expect OFFLINE->SLAVE->MASTER, got %v", path)
+	}
+	if path := def.Path("MASTER", "DROPPED"); !reflect.DeepEqual(path, []string{"SLAVE", "OFFLINE", "DROPPED"}) {
+		t.Errorf("expect MASTER->SLAVE->OFFLINE->DROPPED, got %v", path)
+	}
+	if path := def.Path("MASTER", "MASTER"); path == nil || len(path) != 0 {
+		t.Errorf("expect an empty path, got %v", path)
+	}
+	if path := def.Path("DROPPED", "MASTER"); path != nil {
+		t.Errorf("expect no path out of DROPPED, got %v", path)
+	}
+
+	if states := def.UnreachableStates(); len(states) != 0 {
+		t.Errorf("expect every state reachable, got %v", states)
+	}
+
+	r, _ = NewRecordFromBytes([]byte(HelixDefaultNodes["STORAGE_DEFAULT_SM_SCHEMATA"]))
+	def, _ = NewStateModelDefinitionFromRecord(r)
+	if states := def.UnreachableStates(); !reflect.DeepEqual(states, []string{"DROPPED"}) {
+		t.Errorf("expect DROPPED unreachable, got %v", states)
+	}
+}
+
+func TestStateModelDefinitionNextFields(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		model, from, to, next string
+	}{
+		// the {STATE}.next map fields win over the transitions, which have no OFFLINE-DROPPED
+		{"STORAGE_DEFAULT_SM_SCHEMATA", "MASTER", "DROPPED", "OFFLINE"},
+		{"STORAGE_DEFAULT_SM_SCHEMATA", "OFFLINE", "DROPPED", "DROPPED"},
+		{"STORAGE_DEFAULT_SM_SCHEMATA", "ERROR", "OFFLINE", "OFFLINE"},
+		{StateModelTask, "INIT", "INIT", "INIT"},
+		{StateModelTask, "RUNNING", "RUNNING", "RUNNING"},
+		{StateModelTask, "INIT", "COMPLETED", "RUNNING"},
+		{StateModelSchedulerTaskQueue, "OFFLINE", "OFFLINE", "OFFLINE"},
+		{StateModelSchedulerTaskQueue, "COMPLETED", "COMPLETED", "COMPLETED"},
+		{StateModelSchedulerTaskQueue, "DROPPED", "DROPPED", "DROPPED"},
+	} {
+		def := getTestStateModelDef(t, tt.model)
+		if next := def.NextState(tt.from, tt.to); next != tt.next {
+			t.Errorf("%s: expect %s->%s through %s, got %q", tt.model, tt.from, tt.to, tt.next, next)
+		}
+	}
+
+	def := getTestStateModelDef(t, "STORAGE_DEFAULT_SM_SCHEMATA")
+	if path := def.Path("MASTER", "DROPPED"); !reflect.DeepEqual(path, []string{"OFFLINE", "DROPPED"}) {
+		t.Errorf("expect MASTER->OFFLINE->DROPPED, got %v", path)
+	}
+
+	// {STATE}.next map fields leading in circles give no path
+	r := def.Record()
+	r.SetMapField("MASTER.next", "DROPPED", "OFFLINE")
+	r.SetMapField("OFFLINE.next", "DROPPED", "MASTER")
+	looping, err := NewStateModelDefinitionFromRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := looping.Path("MASTER", "DROPPED"); path != nil {
+		t.Errorf("expect no path, got %v", path)
+	}
+}
+
+func TestStateModelDefinitionAllowsTransition(t *testing.T) {
+	t.Parallel()
+
+	r, _ := NewRecordFromBytes([]byte(HelixDefaultNodes[StateModelMasterSlave]))
+	def, _ := NewStateModelDefinitionFromRecord(r)
+
+	for _, tt := range []struct {
+		from, to string
+		allowed  bool
+	}{
+		{"OFFLINE", "SLAVE", true},
+		{"SLAVE", "MASTER", true},
+		{"OFFLINE", "MASTER", false},
+		{"MASTER", "OFFLINE", false},
+		{"ERROR", "OFFLINE", true},
+		{"ERROR", "DROPPED", true},
+		{"ERROR", "MASTER", false},
+	} {
+		if def.AllowsTransition(tt.from, tt.to) != tt.allowed {
+			t.Errorf("expect %s-%s allowed %v", tt.from, tt.to, tt.allowed)
+		}
+	}
+}
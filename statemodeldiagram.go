@@ -0,0 +1,127 @@
+package gohelix
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// diagram formats of a state model definition
+const (
+	DiagramFormatDOT     = "dot"
+	DiagramFormatMermaid = "mermaid"
+)
+
+// Diagram renders the definition in the format, DiagramFormatDOT for Graphviz or
+// DiagramFormatMermaid, e.g. for `dot -Tsvg`. The states are labeled with their priority
+// and count constraint, the transitions with their priority, and the initial state is
+// entered from a start point.
+func (def *StateModelDefinition) Diagram(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case DiagramFormatDOT:
+		return def.dot(), nil
+	case DiagramFormatMermaid:
+		return def.mermaid(), nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrUnknownDiagramFormat, format)
+}
+
+// stateLabel describes the state with its priority, 1 the highest, and its count
+// constraint, e.g. "MASTER (priority 1, count 1)"
+func (def *StateModelDefinition) stateLabel(priority int, state string) string {
+	label := fmt.Sprintf("%s (priority %d", state, priority)
+	if count, ok := def.StateCounts[state]; ok {
+		label += ", count " + count
+	}
+	return label + ")"
+}
+
+func (def *StateModelDefinition) dot() string {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "digraph %s {\n", strconv.Quote(def.Name))
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [shape=box, style=rounded];\n")
+
+	if def.InitialState != "" {
+		b.WriteString("\t__start [shape=point, label=\"\"];\n")
+	}
+	for i, state := range def.States {
+		fmt.Fprintf(&b, "\t%s [label=%s];\n", strconv.Quote(state), strconv.Quote(def.stateLabel(i+1, state)))
+	}
+
+	if def.InitialState != "" {
+		fmt.Fprintf(&b, "\t__start -> %s;\n", strconv.Quote(def.InitialState))
+	}
+	for i, t := range def.Transitions {
+		fmt.Fprintf(&b, "\t%s -> %s [label=\"%d\"];\n", strconv.Quote(t.FromState), strconv.Quote(t.ToState), i+1)
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// mermaidID turns the state into a mermaid state id, which only takes letters, digits
+// and underscores
+func mermaidID(state string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return '_'
+	}, state)
+}
+
+func (def *StateModelDefinition) mermaid() string {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "---\ntitle: %s\n---\n", def.Name)
+	b.WriteString("stateDiagram-v2\n")
+	b.WriteString("    direction LR\n")
+
+	for i, state := range def.States {
+		fmt.Fprintf(&b, "    state \"%s\" as %s\n", def.stateLabel(i+1, state), mermaidID(state))
+	}
+
+	if def.InitialState != "" {
+		fmt.Fprintf(&b, "    [*] --> %s\n", mermaidID(def.InitialState))
+	}
+	for i, t := range def.Transitions {
+		fmt.Fprintf(&b, "    %s --> %s : %d\n", mermaidID(t.FromState), mermaidID(t.ToState), i+1)
+	}
+
+	return b.String()
+}
+
+// Definition returns the definition implied by the transitions of the state model, to
+// render it with Diagram before the real definition is written. The states come in the
+// order the transitions first use them, the transitions in the order they were added,
+// and no state is bounded.
+func (sm *StateModel) Definition(name string, initialState string) *StateModelDefinition {
+	def := &StateModelDefinition{
+		Name:         name,
+		InitialState: initialState,
+		StateCounts:  map[string]string{},
+	}
+
+	seen := map[string]bool{}
+	addState := func(state string) {
+		if !seen[state] {
+			seen[state] = true
+			def.States = append(def.States, state)
+		}
+	}
+
+	if initialState != "" {
+		addState(initialState)
+	}
+	for _, t := range sm.transitions {
+		addState(t.fromState)
+		addState(t.toState)
+		def.Transitions = append(def.Transitions, StateModelTransition{t.fromState, t.toState})
+	}
+
+	return def
+}
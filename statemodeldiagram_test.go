@@ -0,0 +1,73 @@
+package gohelix
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStateModelDefinitionDiagram(t *testing.T) {
+	t.Parallel()
+
+	r, _ := NewRecordFromBytes([]byte(HelixDefaultNodes[StateModelMasterSlave]))
+	def, err := NewStateModelDefinitionFromRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dot, err := def.Diagram("dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`digraph "MasterSlave" {`,
+		`"MASTER" [label="MASTER (priority 1, count 1)"];`,
+		`"SLAVE" [label="SLAVE (priority 2, count R)"];`,
+		`"OFFLINE" [label="OFFLINE (priority 3)"];`,
+		`__start -> "OFFLINE";`,
+		`"MASTER" -> "SLAVE" [label="1"];`,
+	} {
+		if !strings.Contains(dot, "\t"+line+"\n") && !strings.HasPrefix(dot, line+"\n") {
+			t.Errorf("expect %s in\n%s", line, dot)
+		}
+	}
+
+	mermaid, err := def.Diagram("mermaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`stateDiagram-v2`,
+		`    state "SLAVE (priority 2, count R)" as SLAVE`,
+		`    [*] --> OFFLINE`,
+		`    OFFLINE --> SLAVE : 3`,
+	} {
+		if !strings.Contains(mermaid, "\n"+line+"\n") {
+			t.Errorf("expect %s in\n%s", line, mermaid)
+		}
+	}
+
+	if _, err := def.Diagram("png"); !errors.Is(err, ErrUnknownDiagramFormat) {
+		t.Errorf("expect ErrUnknownDiagramFormat, got %v", err)
+	}
+}
+
+func TestStateModelDiagram(t *testing.T) {
+	t.Parallel()
+
+	sm := NewStateModel([]Transition{
+		{"OFFLINE", "ONLINE", nil},
+		{"ONLINE", "OFFLINE", nil},
+		{"OFFLINE", "DROPPED", nil},
+	})
+
+	def := sm.Definition("OnlineOffline", "OFFLINE")
+	if strings.Join(def.States, ",") != "OFFLINE,ONLINE,DROPPED" || len(def.Transitions) != 3 || def.Transitions[2].String() != "OFFLINE-DROPPED" {
+		t.Errorf("wrong definition %+v", def)
+	}
+
+	mermaid, _ := def.Diagram("mermaid")
+	if !strings.Contains(mermaid, "\n    ONLINE --> OFFLINE : 2\n") {
+		t.Errorf("expect ONLINE --> OFFLINE in\n%s", mermaid)
+	}
+}
@@ -0,0 +1,92 @@
+package gohelix
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/yichen/go-zookeeper/zk"
+)
+
+// updateStatus records the status of the transition of the message in the status update
+// history of its partition, /{cluster}/INSTANCES/{instance}/STATUSUPDATES/{session}/{resource}/{partition}.
+// Each transition is a map field keyed by the message ID, with the time the message was
+// received, the time the transition started and ended, its duration and its error if any.
+func (p *Participant) updateStatus(message *Record, status string, transitionErr error) {
+	if p.statusUpdateRetention < 1 {
+		return
+	}
+
+	resourceID := message.GetStringField("RESOURCE_NAME", "")
+	partitionName := message.GetStringField("PARTITION_NAME", "")
+	path := p.kb.statusUpdate(p.ParticipantID, p.conn.GetSessionID(), resourceID, partitionName)
+
+	if exists, _ := p.conn.Exists(path); !exists {
+		if err := p.conn.CreateRecordWithPath(path, NewRecord(partitionName)); err != nil && err != zk.ErrNodeExists {
+			Logger.Printf("Failed to create the status updates of %s: %s\n", partitionName, err.Error())
+			return
+		}
+	}
+
+	nowMilli := time.Now().UnixNano() / 1000000
+	err := p.conn.updateRecord(path, func(record *Record) {
+		setStatusUpdate(record, message, status, transitionErr, nowMilli)
+		trimStatusUpdates(record, p.statusUpdateRetention)
+	})
+	if err != nil {
+		Logger.Printf("Failed to update the status of %s: %s\n", partitionName, err.Error())
+	}
+}
+
+// setStatusUpdate sets the status of the transition of the message in the status updates
+// of its partition, at the given time in milliseconds.
+func setStatusUpdate(record *Record, message *Record, status string, transitionErr error, nowMilli int64) {
+	key := message.ID
+	now := strconv.FormatInt(nowMilli, 10)
+
+	if _, ok := record.MapFields[key]; !ok {
+		record.SetMapField(key, "MSG_ID", message.ID)
+		record.SetMapField(key, "FROM_STATE", message.GetStringField("FROM_STATE", ""))
+		record.SetMapField(key, "TO_STATE", message.GetStringField("TO_STATE", ""))
+		record.SetMapField(key, "RECEIVED_TIMESTAMP", message.GetStringField("READ_TIMESTAMP", now))
+	}
+	record.SetMapField(key, "STATUS", status)
+
+	if status == "STARTED" {
+		record.SetMapField(key, "START_TIMESTAMP", now)
+		return
+	}
+
+	record.SetMapField(key, "END_TIMESTAMP", now)
+	if start, err := strconv.ParseInt(record.GetMapField(key, "START_TIMESTAMP"), 10, 64); err == nil {
+		record.SetMapField(key, "DURATION", strconv.FormatInt(nowMilli-start, 10))
+	}
+	if transitionErr != nil {
+		record.SetMapField(key, "ERROR", transitionErr.Error())
+	}
+}
+
+// trimStatusUpdates drops the oldest transitions from the status updates, by the time their
+// message was received, so that at most retention transitions are kept.
+func trimStatusUpdates(record *Record, retention int) {
+	if len(record.MapFields) <= retention {
+		return
+	}
+
+	keys := make([]string, 0, len(record.MapFields))
+	for key := range record.MapFields {
+		keys = append(keys, key)
+	}
+
+	received := func(key string) int64 {
+		t, _ := strconv.ParseInt(record.GetMapField(key, "RECEIVED_TIMESTAMP"), 10, 64)
+		return t
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return received(keys[i]) < received(keys[j])
+	})
+
+	for _, key := range keys[:len(keys)-retention] {
+		record.RemoveMapField(key)
+	}
+}
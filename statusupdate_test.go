@@ -0,0 +1,54 @@
+package gohelix
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSetStatusUpdate(t *testing.T) {
+	t.Parallel()
+
+	message := NewRecord("msg")
+	message.SetSimpleField("FROM_STATE", "OFFLINE")
+	message.SetSimpleField("TO_STATE", "ONLINE")
+	message.SetSimpleField("READ_TIMESTAMP", "1000")
+
+	record := NewRecord("db_0")
+	setStatusUpdate(record, message, "STARTED", nil, 1200)
+	if record.GetMapField("msg", "STATUS") != "STARTED" ||
+		record.GetMapField("msg", "RECEIVED_TIMESTAMP") != "1000" ||
+		record.GetMapField("msg", "START_TIMESTAMP") != "1200" {
+		t.Errorf("wrong status update %v", record.MapFields["msg"])
+	}
+
+	setStatusUpdate(record, message, "FAILED", errors.New("disk full"), 1500)
+	if record.GetMapField("msg", "STATUS") != "FAILED" ||
+		record.GetMapField("msg", "END_TIMESTAMP") != "1500" ||
+		record.GetMapField("msg", "DURATION") != "300" ||
+		record.GetMapField("msg", "ERROR") != "disk full" ||
+		record.GetMapField("msg", "FROM_STATE") != "OFFLINE" {
+		t.Errorf("wrong status update %v", record.MapFields["msg"])
+	}
+}
+
+func TestTrimStatusUpdates(t *testing.T) {
+	t.Parallel()
+
+	record := NewRecord("db_0")
+	for i := 0; i < 5; i++ {
+		message := NewRecord(fmt.Sprintf("msg%d", i))
+		message.SetSimpleField("READ_TIMESTAMP", fmt.Sprintf("%d", 1000+i))
+		setStatusUpdate(record, message, "COMPLETED", nil, int64(2000+i))
+	}
+
+	trimStatusUpdates(record, 3)
+	if len(record.MapFields) != 3 {
+		t.Errorf("expect 3 status updates, got %d", len(record.MapFields))
+	}
+	for _, key := range []string{"msg2", "msg3", "msg4"} {
+		if _, ok := record.MapFields[key]; !ok {
+			t.Errorf("expect %s to be kept", key)
+		}
+	}
+}
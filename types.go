@@ -29,6 +29,10 @@ type (
 
 	// MessageListener is triggered when the instance received new messages
 	MessageListener func(instance string, messages []*Record, context *Context)
+
+	// HealthReportProvider reports a health metric of the participant, like the disk
+	// usage, the replication lag or the queue depth, as key value pairs
+	HealthReportProvider func() map[string]string
 )
 
 type AddResourceOption struct {
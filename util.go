@@ -2,6 +2,7 @@ package gohelix
 
 import (
 	"bufio"
+	"crypto/rand"
 	"fmt"
 	"strings"
 
@@ -120,12 +121,6 @@ func RunCommand(command string) (string, error) {
 	return "", nil
 }
 
-func must(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
-
 func strSliceContains(a []string, s string) bool {
 	for _, ele := range a {
 		if ele == s {
@@ -135,3 +130,15 @@ func strSliceContains(a []string, s string) bool {
 
 	return false
 }
+
+// newUUID generates a random UUID, used as the ID of the messages
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	// version 4, variant 10
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}